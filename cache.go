@@ -0,0 +1,519 @@
+package geocn
+
+import (
+	"context"
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// CacheConfig holds the lookup cache settings shared by the geocn and
+// geocity apps.
+type CacheConfig struct {
+	EnableCache  *bool          `json:"enable_cache,omitempty"`
+	CacheTTL     caddy.Duration `json:"cache_ttl,omitempty"`
+	CacheMaxSize int            `json:"cache_max_size,omitempty"`
+	// CachePolicy selects the eviction policy: random (default), lru or tinylfu.
+	CachePolicy string `json:"cache_policy,omitempty"`
+	// CacheNegativeTTL is how long lookups that found no data are cached,
+	// separately from CacheTTL. Default 1m.
+	CacheNegativeTTL caddy.Duration `json:"cache_negative_ttl,omitempty"`
+	// CacheShards splits the cache into independently locked shards to
+	// reduce contention under high concurrency. Default 1.
+	CacheShards int `json:"cache_shards,omitempty"`
+	// CachePersist snapshots the cache to disk periodically and when the
+	// app stops, and restores it on the next start.
+	CachePersist bool `json:"cache_persist,omitempty"`
+	// CacheMaxMemory bounds the approximate bytes held by the cache. When
+	// set without CacheMaxSize, the entry count is unbounded.
+	CacheMaxMemory int64 `json:"cache_max_memory,omitempty"`
+}
+
+// validate checks the settings NewCache would silently fall back on.
+func (c CacheConfig) validate() error {
+	if c.CacheShards < 0 || c.CacheShards > maxCacheShards {
+		return fmt.Errorf("cache shards must be between 1 and %d", maxCacheShards)
+	}
+	if c.CacheMaxMemory < 0 {
+		return fmt.Errorf("cache max_memory must not be negative")
+	}
+	return checkEvictionPolicy(c.CachePolicy)
+}
+
+// options converts the settings into NewCache options.
+func (c CacheConfig) options() []CacheOption {
+	return []CacheOption{
+		WithEvictionPolicy(c.CachePolicy),
+		WithShards(c.CacheShards),
+		WithMaxMemory(c.CacheMaxMemory),
+	}
+}
+
+// maxCacheShards bounds the shard count; beyond this, per-shard capacity
+// gets too small for eviction to behave sensibly.
+const maxCacheShards = 256
+
+// entryOverhead approximates the bytes an entry costs beyond its key and
+// value: the map slot, the entry struct and eviction policy bookkeeping.
+const entryOverhead = 96
+
+// Cache is a generic TTL cache with pluggable eviction (random by default).
+// Keys are spread over one or more shards, each with its own lock, entry
+// budget and eviction state.
+type Cache[K comparable, V any] struct {
+	shards []*cacheShard[K, V]
+	seed   maphash.Seed
+	ttl    time.Duration
+}
+
+type cacheShard[K comparable, V any] struct {
+	mu       sync.RWMutex
+	entries  map[K]*cacheEntry[V]
+	maxSize  int   // 0 means no entry limit
+	maxBytes int64 // 0 means no byte limit
+	bytes    int64
+	policy   evictionPolicy[K] // nil means random eviction
+}
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+	cost    int64
+}
+
+// CacheOption configures optional Cache behaviour.
+type CacheOption func(*cacheOptions)
+
+type cacheOptions struct {
+	policy    string
+	shards    int
+	maxMemory int64
+}
+
+// WithEvictionPolicy selects the eviction policy: random, lru or tinylfu.
+// Unknown names fall back to random.
+func WithEvictionPolicy(name string) CacheOption {
+	return func(o *cacheOptions) { o.policy = name }
+}
+
+// WithShards splits the cache into n shards selected by key hash. The max
+// size is divided evenly between them. Values below 1 mean a single shard.
+func WithShards(n int) CacheOption {
+	return func(o *cacheOptions) { o.shards = n }
+}
+
+// WithMaxMemory bounds the approximate bytes held by the cache, split
+// evenly between shards. Entries are evicted until a new one fits. A max
+// size of 0 passed to NewCache then leaves the entry count unbounded.
+func WithMaxMemory(bytes int64) CacheOption {
+	return func(o *cacheOptions) { o.maxMemory = bytes }
+}
+
+// NewCache creates a new cache with the given max size and TTL.
+func NewCache[K comparable, V any](maxSize int, ttl time.Duration, opts ...CacheOption) *Cache[K, V] {
+	var o cacheOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	n := min(max(o.shards, 1), maxCacheShards)
+	perShard := max((maxSize+n-1)/n, 1)
+	var perShardBytes int64
+	if o.maxMemory > 0 {
+		perShardBytes = max((o.maxMemory+int64(n)-1)/int64(n), 1)
+		if maxSize <= 0 {
+			perShard = 0
+		}
+	}
+	// Frequency sketches are sized by the expected number of entries.
+	sizeHint := perShard
+	if sizeHint == 0 {
+		sizeHint = int(perShardBytes / (2 * entryOverhead))
+	}
+
+	c := &Cache[K, V]{
+		shards: make([]*cacheShard[K, V], n),
+		seed:   maphash.MakeSeed(),
+		ttl:    ttl,
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard[K, V]{
+			entries:  make(map[K]*cacheEntry[V]),
+			maxSize:  perShard,
+			maxBytes: perShardBytes,
+			policy:   newEvictionPolicy[K](o.policy, sizeHint),
+		}
+	}
+	return c
+}
+
+// shard returns the shard owning key.
+func (c *Cache[K, V]) shard(key K) *cacheShard[K, V] {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[maphash.Comparable(c.seed, key)%uint64(len(c.shards))]
+}
+
+// Get retrieves a value from the cache. Returns the value and whether it was found.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	s := c.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, exists := s.entries[key]
+	hit := exists && !time.Now().After(entry.expires)
+	if s.policy != nil {
+		s.policy.access(key, hit)
+	}
+	if !hit {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Set stores a value in the cache with the default TTL. A full cache may
+// decline a new key when the eviction policy judges it less valuable than
+// the victim.
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+// SetWithTTL stores a value that expires after ttl instead of the default.
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	s := c.shard(key)
+	cost := entryCost(key, value)
+	if s.maxBytes > 0 && cost > s.maxBytes {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.needsRoom(key, cost) {
+		before := len(s.entries)
+		if !s.evictOne(key) {
+			return
+		}
+		if len(s.entries) == before {
+			break
+		}
+	}
+
+	if old, exists := s.entries[key]; exists {
+		s.bytes -= old.cost
+	}
+	s.entries[key] = &cacheEntry[V]{
+		value:   value,
+		expires: time.Now().Add(ttl),
+		cost:    cost,
+	}
+	s.bytes += cost
+	if s.policy != nil {
+		s.policy.add(key)
+	}
+}
+
+// needsRoom reports whether storing key at the given cost would exceed the
+// shard's entry or byte budget.
+func (s *cacheShard[K, V]) needsRoom(key K, cost int64) bool {
+	n, bytes := len(s.entries), s.bytes+cost
+	if old, exists := s.entries[key]; exists {
+		n--
+		bytes -= old.cost
+	}
+	return (s.maxSize > 0 && n >= s.maxSize) || (s.maxBytes > 0 && bytes > s.maxBytes)
+}
+
+// remove deletes key and releases its cost.
+func (s *cacheShard[K, V]) remove(key K) {
+	entry, exists := s.entries[key]
+	if !exists {
+		return
+	}
+	delete(s.entries, key)
+	s.bytes -= entry.cost
+	if s.policy != nil {
+		s.policy.remove(key)
+	}
+}
+
+// entryCost approximates the memory an entry occupies. Strings and byte
+// slices are counted by length, other types by their in-place size.
+func entryCost[K comparable, V any](key K, value V) int64 {
+	cost := int64(unsafe.Sizeof(key)) + int64(unsafe.Sizeof(value)) + entryOverhead
+	if k, ok := any(key).(string); ok {
+		cost += int64(len(k))
+	}
+	switch v := any(value).(type) {
+	case string:
+		cost += int64(len(v))
+	case []byte:
+		cost += int64(cap(v))
+	}
+	return cost
+}
+
+// Len returns the number of cached entries, including expired ones not yet
+// cleaned up.
+func (c *Cache[K, V]) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.RLock()
+		n += len(s.entries)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Bytes returns the approximate memory held by cached entries.
+func (c *Cache[K, V]) Bytes() int64 {
+	var n int64
+	for _, s := range c.shards {
+		s.mu.RLock()
+		n += s.bytes
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// evictOne makes room for candidate and reports whether it may be stored.
+// Without a policy it removes one random entry: for IP geo-lookup caches
+// random eviction is O(1) and avoids the O(n) full-table scan.
+func (s *cacheShard[K, V]) evictOne(candidate K) bool {
+	if s.policy == nil {
+		for key := range s.entries {
+			s.remove(key)
+			return true
+		}
+		return true
+	}
+
+	victim, ok := s.policy.victim()
+	if !ok {
+		return true
+	}
+	// Keys already cached were admitted once; only newcomers are screened.
+	if _, exists := s.entries[candidate]; !exists && !s.policy.admit(candidate, victim) {
+		return false
+	}
+	s.remove(victim)
+	return true
+}
+
+// Purge removes all entries.
+func (c *Cache[K, V]) Purge() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key := range s.entries {
+			s.remove(key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// PurgeFunc removes the entries whose key satisfies match.
+func (c *Cache[K, V]) PurgeFunc(match func(K) bool) {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key := range s.entries {
+			if match(key) {
+				s.remove(key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// cacheItem is a single cache entry as stored in snapshots.
+type cacheItem[K comparable, V any] struct {
+	Key     K
+	Value   V
+	Expires time.Time
+}
+
+// items returns the unexpired entries.
+func (c *Cache[K, V]) items() []cacheItem[K, V] {
+	now := time.Now()
+	var items []cacheItem[K, V]
+	for _, s := range c.shards {
+		s.mu.RLock()
+		for key, entry := range s.entries {
+			if !now.After(entry.expires) {
+				items = append(items, cacheItem[K, V]{Key: key, Value: entry.value, Expires: entry.expires})
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return items
+}
+
+// Cleanup removes expired entries periodically until context is done.
+func (c *Cache[K, V]) Cleanup(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, s := range c.shards {
+				s.removeExpired()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// removeExpired deletes expired entries in two phases to minimize lock
+// contention: collect under the read lock, delete under the write lock.
+func (s *cacheShard[K, V]) removeExpired() {
+	// Phase 1: Collect expired keys with read lock
+	s.mu.RLock()
+	now := time.Now()
+	var keysToDelete []K
+	for key, entry := range s.entries {
+		if now.After(entry.expires) {
+			keysToDelete = append(keysToDelete, key)
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(keysToDelete) == 0 {
+		return
+	}
+
+	// Phase 2: Delete expired entries with write lock
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now = time.Now()
+	for _, key := range keysToDelete {
+		// Re-check to avoid deleting entries updated between phases
+		if entry, exists := s.entries[key]; exists && now.After(entry.expires) {
+			s.remove(key)
+		}
+	}
+}
+
+// prefixCache caches lookup results per network instead of per address:
+// one entry answers every address inside the prefix the database reported,
+// so memory scales with distinct networks rather than distinct clients.
+type prefixCache[V any] struct {
+	entries *Cache[netip.Prefix, V]
+
+	// Prefix lengths that have been cached, one bit per length, so Get only
+	// probes lengths that can possibly hit. Bits are never cleared; a stale
+	// bit merely costs one extra map probe.
+	v4Bits atomic.Uint64
+	v6Bits [3]atomic.Uint64
+}
+
+// newPrefixCache creates a prefix cache with the given max size and TTL.
+func newPrefixCache[V any](maxSize int, ttl time.Duration, opts ...CacheOption) *prefixCache[V] {
+	return &prefixCache[V]{entries: NewCache[netip.Prefix, V](maxSize, ttl, opts...)}
+}
+
+// Get returns the value cached for the most specific network containing addr.
+func (c *prefixCache[V]) Get(addr netip.Addr) (V, bool) {
+	if addr.Is4() {
+		if v, ok := c.probe(addr, c.v4Bits.Load(), 0); ok {
+			return v, true
+		}
+	} else {
+		// Walk the 129 IPv6 lengths longest first, word by word.
+		for word := len(c.v6Bits) - 1; word >= 0; word-- {
+			if v, ok := c.probe(addr, c.v6Bits[word].Load(), word*64); ok {
+				return v, true
+			}
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// probe checks the lengths set in mask (offset by base), longest first.
+func (c *prefixCache[V]) probe(addr netip.Addr, mask uint64, base int) (V, bool) {
+	for mask != 0 {
+		top := 63 - bits.LeadingZeros64(mask)
+		mask &^= 1 << top
+		prefix, err := addr.Prefix(base + top)
+		if err != nil {
+			continue
+		}
+		if v, ok := c.entries.Get(prefix); ok {
+			return v, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// Set caches value for every address in network.
+func (c *prefixCache[V]) Set(network netip.Prefix, value V) {
+	c.SetWithTTL(network, value, c.entries.ttl)
+}
+
+// SetWithTTL caches value for every address in network for ttl.
+func (c *prefixCache[V]) SetWithTTL(network netip.Prefix, value V, ttl time.Duration) {
+	network = network.Masked()
+	n := network.Bits()
+	if network.Addr().Is4() {
+		c.v4Bits.Or(1 << n)
+	} else {
+		c.v6Bits[n/64].Or(1 << (n % 64))
+	}
+	c.entries.SetWithTTL(network, value, ttl)
+}
+
+// Len returns the number of cached networks.
+func (c *prefixCache[V]) Len() int {
+	return c.entries.Len()
+}
+
+// Bytes returns the approximate memory held by the cache.
+func (c *prefixCache[V]) Bytes() int64 {
+	return c.entries.Bytes()
+}
+
+// Purge removes all entries.
+func (c *prefixCache[V]) Purge() {
+	c.entries.Purge()
+}
+
+// PurgeFamily removes the IPv4 networks if is4, the IPv6 networks
+// otherwise.
+func (c *prefixCache[V]) PurgeFamily(is4 bool) {
+	c.entries.PurgeFunc(func(p netip.Prefix) bool { return p.Addr().Is4() == is4 })
+}
+
+// items returns the unexpired entries.
+func (c *prefixCache[V]) items() []cacheItem[netip.Prefix, V] {
+	return c.entries.items()
+}
+
+// restore re-inserts items, keeping their original expiry.
+func (c *prefixCache[V]) restore(items []cacheItem[netip.Prefix, V]) {
+	for _, item := range items {
+		c.SetWithTTL(item.Key, item.Value, time.Until(item.Expires))
+	}
+}
+
+// Cleanup removes expired entries periodically until context is done.
+func (c *prefixCache[V]) Cleanup(ctx context.Context) {
+	c.entries.Cleanup(ctx)
+}
+
+// hostPrefix returns the single-address prefix for addr, used when the
+// database cannot report the enclosing network.
+func hostPrefix(addr netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
@@ -1,6 +1,7 @@
 package geocn
 
 import (
+	"net/netip"
 	"testing"
 	"time"
 )
@@ -10,16 +11,16 @@ func TestIPCacheBehavior(t *testing.T) {
 		cache := newIPCache(100, 5*time.Minute)
 
 		// Cache miss
-		_, found := cache.Get("192.168.1.1")
+		_, found := cache.Get(netip.MustParseAddr("192.168.1.1"))
 		if found {
 			t.Error("Expected cache miss for new key")
 		}
 
 		// Set value
-		cache.Set("192.168.1.1", "CN")
+		cache.Set(netip.MustParsePrefix("192.168.1.1/32"), "CN")
 
 		// Cache hit
-		country, found := cache.Get("192.168.1.1")
+		country, found := cache.Get(netip.MustParseAddr("192.168.1.1"))
 		if !found {
 			t.Error("Expected cache hit after Set")
 		}
@@ -31,10 +32,10 @@ func TestIPCacheBehavior(t *testing.T) {
 	t.Run("cache TTL expiration", func(t *testing.T) {
 		cache := newIPCache(100, 50*time.Millisecond)
 
-		cache.Set("10.0.0.1", "US")
+		cache.Set(netip.MustParsePrefix("10.0.0.1/32"), "US")
 
 		// Should hit immediately
-		_, found := cache.Get("10.0.0.1")
+		_, found := cache.Get(netip.MustParseAddr("10.0.0.1"))
 		if !found {
 			t.Error("Expected cache hit before TTL expiration")
 		}
@@ -43,7 +44,7 @@ func TestIPCacheBehavior(t *testing.T) {
 		time.Sleep(60 * time.Millisecond)
 
 		// Should miss after TTL
-		_, found = cache.Get("10.0.0.1")
+		_, found = cache.Get(netip.MustParseAddr("10.0.0.1"))
 		if found {
 			t.Error("Expected cache miss after TTL expiration")
 		}
@@ -52,20 +53,20 @@ func TestIPCacheBehavior(t *testing.T) {
 	t.Run("cache max size eviction", func(t *testing.T) {
 		cache := newIPCache(3, 5*time.Minute)
 
-		cache.Set("1.1.1.1", "A")
-		cache.Set("2.2.2.2", "B")
-		cache.Set("3.3.3.3", "C")
+		cache.Set(netip.MustParsePrefix("1.1.1.1/32"), "A")
+		cache.Set(netip.MustParsePrefix("2.2.2.2/32"), "B")
+		cache.Set(netip.MustParsePrefix("3.3.3.3/32"), "C")
 
 		// All should be present
-		if _, found := cache.Get("1.1.1.1"); !found {
+		if _, found := cache.Get(netip.MustParseAddr("1.1.1.1")); !found {
 			t.Error("Expected 1.1.1.1 to be in cache")
 		}
 
 		// Add one more, should evict one entry
-		cache.Set("4.4.4.4", "D")
+		cache.Set(netip.MustParsePrefix("4.4.4.4/32"), "D")
 
 		// Newest should be present
-		if _, found := cache.Get("4.4.4.4"); !found {
+		if _, found := cache.Get(netip.MustParseAddr("4.4.4.4")); !found {
 			t.Error("Expected 4.4.4.4 to be in cache")
 		}
 	})
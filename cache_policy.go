@@ -0,0 +1,203 @@
+package geocn
+
+import (
+	"container/list"
+	"fmt"
+	"hash/maphash"
+	"sync"
+)
+
+// Eviction policies selectable with "cache policy <name>".
+const (
+	evictRandom  = "random"
+	evictLRU     = "lru"
+	evictTinyLFU = "tinylfu"
+)
+
+// evictionPolicy tracks key usage for a Cache and picks eviction victims.
+// Methods are called with the cache lock held (access only with the read
+// lock), so implementations synchronize their own state.
+type evictionPolicy[K comparable] interface {
+	// access records a lookup of key; hit reports whether it was cached.
+	access(key K, hit bool)
+	// add records that key was stored.
+	add(key K)
+	// remove records that key was deleted.
+	remove(key K)
+	// victim returns the key that should be evicted next.
+	victim() (K, bool)
+	// admit reports whether candidate may replace victim.
+	admit(candidate, victim K) bool
+}
+
+// checkEvictionPolicy validates a policy name.
+func checkEvictionPolicy(name string) error {
+	switch name {
+	case "", evictRandom, evictLRU, evictTinyLFU:
+		return nil
+	}
+	return fmt.Errorf("unknown cache policy %q (want random, lru or tinylfu)", name)
+}
+
+// newEvictionPolicy returns the named policy, or nil for random eviction,
+// which needs no bookkeeping. Unknown names also fall back to random.
+func newEvictionPolicy[K comparable](name string, maxSize int) evictionPolicy[K] {
+	switch name {
+	case evictLRU:
+		return newLRUPolicy[K]()
+	case evictTinyLFU:
+		return newTinyLFUPolicy[K](maxSize)
+	}
+	return nil
+}
+
+// lruPolicy evicts the least recently used key.
+type lruPolicy[K comparable] struct {
+	mu    sync.Mutex
+	order *list.List // front is most recently used
+	elems map[K]*list.Element
+}
+
+func newLRUPolicy[K comparable]() *lruPolicy[K] {
+	return &lruPolicy[K]{order: list.New(), elems: make(map[K]*list.Element)}
+}
+
+func (p *lruPolicy[K]) access(key K, hit bool) {
+	if !hit {
+		return
+	}
+	p.mu.Lock()
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToFront(e)
+	}
+	p.mu.Unlock()
+}
+
+func (p *lruPolicy[K]) add(key K) {
+	p.mu.Lock()
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToFront(e)
+	} else {
+		p.elems[key] = p.order.PushFront(key)
+	}
+	p.mu.Unlock()
+}
+
+func (p *lruPolicy[K]) remove(key K) {
+	p.mu.Lock()
+	if e, ok := p.elems[key]; ok {
+		p.order.Remove(e)
+		delete(p.elems, key)
+	}
+	p.mu.Unlock()
+}
+
+func (p *lruPolicy[K]) victim() (K, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e := p.order.Back(); e != nil {
+		return e.Value.(K), true
+	}
+	var zero K
+	return zero, false
+}
+
+func (p *lruPolicy[K]) admit(K, K) bool { return true }
+
+// tinyLFUPolicy keeps LRU order for victim selection but only admits a new
+// key when it has been requested at least as often as the victim, estimated
+// with a count-min sketch that halves periodically to age out old
+// popularity. One-off scanners therefore cannot flush hot entries.
+type tinyLFUPolicy[K comparable] struct {
+	*lruPolicy[K]
+	sketch *countMinSketch[K]
+}
+
+func newTinyLFUPolicy[K comparable](maxSize int) *tinyLFUPolicy[K] {
+	return &tinyLFUPolicy[K]{lruPolicy: newLRUPolicy[K](), sketch: newCountMinSketch[K](maxSize)}
+}
+
+func (p *tinyLFUPolicy[K]) access(key K, hit bool) {
+	p.sketch.increment(key)
+	p.lruPolicy.access(key, hit)
+}
+
+func (p *tinyLFUPolicy[K]) admit(candidate, victim K) bool {
+	return p.sketch.estimate(candidate) >= p.sketch.estimate(victim)
+}
+
+// countMinSketch estimates key frequencies with four rows of saturating
+// 4-bit counters stored one per byte.
+type countMinSketch[K comparable] struct {
+	mu        sync.Mutex
+	seed      maphash.Seed
+	rows      [4][]uint8
+	shift     uint // 64 - log2(width)
+	additions int
+	resetAt   int
+}
+
+func newCountMinSketch[K comparable](maxSize int) *countMinSketch[K] {
+	width, bits := 64, uint(6)
+	for width < maxSize {
+		width <<= 1
+		bits++
+	}
+	s := &countMinSketch[K]{
+		seed:    maphash.MakeSeed(),
+		shift:   64 - bits,
+		resetAt: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// Odd multipliers giving each row an independent multiply-shift hash.
+var sketchRowMultipliers = [4]uint64{
+	0x9e3779b97f4a7c15, 0xbf58476d1ce4e5b9, 0x94d049bb133111eb, 0xd6e8feb86659fd93,
+}
+
+// indexes derives one counter index per row from a single 64-bit hash,
+// taking the top bits of a per-row multiplication so that two keys sharing
+// a counter in one row rarely share it in the others.
+func (s *countMinSketch[K]) indexes(key K) [4]uint64 {
+	h := maphash.Comparable(s.seed, key)
+	var idx [4]uint64
+	for i, m := range sketchRowMultipliers {
+		idx[i] = (h * m) >> s.shift
+	}
+	return idx
+}
+
+func (s *countMinSketch[K]) increment(key K) {
+	idx := s.indexes(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, j := range idx {
+		if s.rows[i][j] < 15 {
+			s.rows[i][j]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *countMinSketch[K]) estimate(key K) uint8 {
+	idx := s.indexes(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	est := uint8(15)
+	for i, j := range idx {
+		est = min(est, s.rows[i][j])
+	}
+	return est
+}
@@ -0,0 +1,172 @@
+package geocn
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// cachePool holds lookup caches across config reloads. App instances whose
+// cache settings and database sources are unchanged share one cache, so a
+// reload keeps the warm entries instead of starting empty.
+var cachePool = caddy.NewUsagePool()
+
+// snapshotInterval is how often a persistent cache is written to disk.
+const snapshotInterval = 5 * time.Minute
+
+// sharedCache is the cachePool value: the cache plus the goroutine that
+// expires (and optionally snapshots) its entries for as long as any app
+// instance uses it.
+type sharedCache[V any] struct {
+	*prefixCache[V]
+	key      string
+	snapshot string // empty disables persistence
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	logger   *zap.Logger
+}
+
+// cacheSnapshot is the on-disk format. Key guards against restoring entries
+// produced under different settings or databases.
+type cacheSnapshot[V any] struct {
+	Key   string
+	Items []cacheItem[netip.Prefix, V]
+}
+
+// cachePoolKey identifies a cache by the owning app, its settings and the
+// databases its entries were derived from: their sources and the dbPool
+// keys of the loaded content, so a snapshot taken before a database
+// changed is not restored.
+func cachePoolKey(app string, cfg CacheConfig, databases ...string) string {
+	settings, _ := json.Marshal(cfg)
+	return fmt.Sprintf("%s|%s|%q", app, settings, databases)
+}
+
+// acquireCache returns the pooled cache for key, creating it with create
+// (and restoring the snapshot file, if any) when no instance holds it yet.
+// Each call must be paired with releaseCache.
+func acquireCache[V any](key, snapshot string, logger *zap.Logger, create func() *prefixCache[V]) (*prefixCache[V], error) {
+	val, loaded, err := cachePool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		sc := &sharedCache[V]{
+			prefixCache: create(),
+			key:         key,
+			snapshot:    snapshot,
+			cancel:      cancel,
+			logger:      logger,
+		}
+		if snapshot != "" {
+			if n, err := sc.load(); err != nil {
+				logger.Warn("failed to restore cache snapshot", zap.String("file", snapshot), zap.Error(err))
+			} else if n > 0 {
+				logger.Info("restored cache snapshot", zap.String("file", snapshot), zap.Int("entries", n))
+			}
+		}
+		sc.wg.Go(func() { sc.run(ctx) })
+		return sc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := val.(*sharedCache[V])
+	if !ok {
+		cachePool.Delete(key)
+		return nil, fmt.Errorf("cache pool entry has wrong type %T", val)
+	}
+	if loaded {
+		logger.Info("reusing lookup cache from previous config", zap.Int("entries", sc.Len()))
+	}
+	return sc.prefixCache, nil
+}
+
+// releaseCache drops one reference to the pooled cache; the last release
+// stops its cleanup goroutine and writes the final snapshot.
+func releaseCache(key string) error {
+	if key == "" {
+		return nil
+	}
+	_, err := cachePool.Delete(key)
+	return err
+}
+
+func (sc *sharedCache[V]) run(ctx context.Context) {
+	if sc.snapshot == "" {
+		sc.Cleanup(ctx)
+		return
+	}
+
+	sc.wg.Go(func() { sc.Cleanup(ctx) })
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := sc.save(); err != nil {
+				sc.logger.Warn("failed to save cache snapshot", zap.String("file", sc.snapshot), zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Destruct implements caddy.Destructor. It stops the background
+// goroutines and waits for them before writing the final snapshot.
+func (sc *sharedCache[V]) Destruct() error {
+	sc.cancel()
+	sc.wg.Wait()
+	if sc.snapshot == "" {
+		return nil
+	}
+	return sc.save()
+}
+
+// save writes the unexpired entries to the snapshot file atomically.
+func (sc *sharedCache[V]) save() error {
+	tempFile := sc.snapshot + ".temp"
+	f, err := os.Create(tempFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile)
+
+	err = gob.NewEncoder(f).Encode(cacheSnapshot[V]{Key: sc.key, Items: sc.items()})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile, sc.snapshot)
+}
+
+// load reads the snapshot file and reports how many entries it held. A
+// missing file or one written under a different key restores nothing.
+func (sc *sharedCache[V]) load() (int, error) {
+	f, err := os.Open(sc.snapshot)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var snap cacheSnapshot[V]
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil {
+		return 0, err
+	}
+	if snap.Key != sc.key {
+		return 0, nil
+	}
+	sc.prefixCache.restore(snap.Items)
+	return len(snap.Items), nil
+}
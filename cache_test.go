@@ -2,16 +2,24 @@ package geocn
 
 import (
 	"fmt"
+	"math/rand"
+	"net/netip"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	geoip2 "github.com/oschwald/geoip2-golang/v2"
+	"go.uber.org/zap"
 )
 
 func TestIPCache(t *testing.T) {
 	cache := newIPCache(100, 5*time.Minute)
 
 	// Test set and get
-	cache.Set("1.1.1.1", "US")
-	country, found := cache.Get("1.1.1.1")
+	cache.Set(netip.MustParsePrefix("1.1.1.1/32"), "US")
+	country, found := cache.Get(netip.MustParseAddr("1.1.1.1"))
 	if !found {
 		t.Error("expected to find cached entry")
 	}
@@ -20,26 +28,26 @@ func TestIPCache(t *testing.T) {
 	}
 
 	// Test cache miss
-	_, found = cache.Get("2.2.2.2")
+	_, found = cache.Get(netip.MustParseAddr("2.2.2.2"))
 	if found {
 		t.Error("expected cache miss for non-existent IP")
 	}
 
 	// Test eviction: adding a 3rd entry to a size-2 cache should evict one entry
 	smallCache := newIPCache(2, 5*time.Minute)
-	smallCache.Set("1.1.1.1", "US")
-	smallCache.Set("2.2.2.2", "CN")
-	smallCache.Set("3.3.3.3", "JP") // should evict one existing entry
+	smallCache.Set(netip.MustParsePrefix("1.1.1.1/32"), "US")
+	smallCache.Set(netip.MustParsePrefix("2.2.2.2/32"), "CN")
+	smallCache.Set(netip.MustParsePrefix("3.3.3.3/32"), "JP") // should evict one existing entry
 
 	// Verify the new entry exists
-	_, found = smallCache.Get("3.3.3.3")
+	_, found = smallCache.Get(netip.MustParseAddr("3.3.3.3"))
 	if !found {
 		t.Error("expected new entry to exist after eviction")
 	}
 
 	// Verify exactly one of the old entries was evicted
-	_, found1 := smallCache.Get("1.1.1.1")
-	_, found2 := smallCache.Get("2.2.2.2")
+	_, found1 := smallCache.Get(netip.MustParseAddr("1.1.1.1"))
+	_, found2 := smallCache.Get(netip.MustParseAddr("2.2.2.2"))
 	if found1 && found2 {
 		t.Error("expected one entry to be evicted, but both still exist")
 	}
@@ -49,9 +57,9 @@ func TestIPCache(t *testing.T) {
 
 	// Test TTL expiration
 	expireCache := newIPCache(100, 100*time.Millisecond)
-	expireCache.Set("1.1.1.1", "US")
+	expireCache.Set(netip.MustParsePrefix("1.1.1.1/32"), "US")
 	time.Sleep(200 * time.Millisecond)
-	_, found = expireCache.Get("1.1.1.1")
+	_, found = expireCache.Get(netip.MustParseAddr("1.1.1.1"))
 	if found {
 		t.Error("expected entry to be expired")
 	}
@@ -61,8 +69,8 @@ func TestCityCache(t *testing.T) {
 	cache := newCityCache(100, 5*time.Minute)
 
 	// Test set and get
-	cache.Set("1.1.1.1", "中国|0|北京|北京市|联通")
-	region, found := cache.Get("1.1.1.1")
+	cache.Set(netip.MustParsePrefix("1.1.1.1/32"), "中国|0|北京|北京市|联通")
+	region, found := cache.Get(netip.MustParseAddr("1.1.1.1"))
 	if !found {
 		t.Error("expected to find cached entry")
 	}
@@ -71,16 +79,16 @@ func TestCityCache(t *testing.T) {
 	}
 
 	// Test cache miss
-	_, found = cache.Get("2.2.2.2")
+	_, found = cache.Get(netip.MustParseAddr("2.2.2.2"))
 	if found {
 		t.Error("expected cache miss for non-existent IP")
 	}
 
 	// Test TTL expiration
 	expireCache := newCityCache(100, 100*time.Millisecond)
-	expireCache.Set("1.1.1.1", "test")
+	expireCache.Set(netip.MustParsePrefix("1.1.1.1/32"), "test")
 	time.Sleep(200 * time.Millisecond)
-	_, found = expireCache.Get("1.1.1.1")
+	_, found = expireCache.Get(netip.MustParseAddr("1.1.1.1"))
 	if found {
 		t.Error("expected entry to be expired")
 	}
@@ -91,33 +99,335 @@ func BenchmarkIPCache(b *testing.B) {
 
 	// Warm up cache
 	for i := 0; i < 1000; i++ {
-		ip := fmt.Sprintf("192.168.%d.%d", i/256, i%256)
-		cache.Set(ip, "CN")
+		ip := netip.AddrFrom4([4]byte{192, 168, byte(i / 256), byte(i % 256)})
+		cache.Set(hostPrefix(ip), "CN")
 	}
 
+	hot := netip.MustParseAddr("192.168.1.1")
+
 	b.ResetTimer()
 
 	b.Run("Get", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			cache.Get("192.168.1.1")
+			cache.Get(hot)
 		}
 	})
 
 	b.Run("Set", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
-			cache.Set(ip, "US")
+			ip := netip.AddrFrom4([4]byte{10, 0, byte(i / 256), byte(i % 256)})
+			cache.Set(hostPrefix(ip), "US")
 		}
 	})
 
 	b.Run("Mixed", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
 			if i%2 == 0 {
-				cache.Get("192.168.1.1")
+				cache.Get(hot)
 			} else {
-				ip := fmt.Sprintf("172.16.%d.%d", i/256, i%256)
-				cache.Set(ip, "JP")
+				ip := netip.AddrFrom4([4]byte{172, 16, byte(i / 256), byte(i % 256)})
+				cache.Set(hostPrefix(ip), "JP")
+			}
+		}
+	})
+
+	// Hit ratio under Zipf-distributed traffic: 1000 entries serving
+	// 100000 distinct networks, where a few networks dominate.
+	for _, policy := range []string{evictRandom, evictLRU, evictTinyLFU} {
+		b.Run("Zipf/"+policy, func(b *testing.B) {
+			cache := newIPCache(1000, 5*time.Minute, WithEvictionPolicy(policy))
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, 100000-1)
+			keys := make([]netip.Prefix, 1<<16)
+			for i := range keys {
+				n := uint32(zipf.Uint64())
+				keys[i] = netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(n >> 16), byte(n >> 8), byte(n)}), 32)
 			}
+
+			hits := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := keys[i%len(keys)]
+				if _, found := cache.Get(key.Addr()); found {
+					hits++
+				} else {
+					cache.Set(key, "CN")
+				}
+			}
+			b.ReportMetric(float64(hits)/float64(b.N), "hit-ratio")
+		})
+	}
+}
+
+// BenchmarkIPCacheParallel measures lock contention with concurrent readers
+// and writers, comparing a single shard against a sharded cache.
+func BenchmarkIPCacheParallel(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		cache := newIPCache(10000, 5*time.Minute, WithShards(shards))
+		for i := 0; i < 1000; i++ {
+			ip := netip.AddrFrom4([4]byte{192, 168, byte(i / 256), byte(i % 256)})
+			cache.Set(hostPrefix(ip), "CN")
+		}
+
+		b.Run(fmt.Sprintf("Get/shards=%d", shards), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					cache.Get(netip.AddrFrom4([4]byte{192, 168, byte(i % 1000 / 256), byte(i % 1000 % 256)}))
+				}
+			})
+		})
+
+		b.Run(fmt.Sprintf("Mixed/shards=%d", shards), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					ip := netip.AddrFrom4([4]byte{172, 16, byte(i / 256), byte(i % 256)})
+					if i%4 == 0 {
+						cache.Set(hostPrefix(ip), "JP")
+					} else {
+						cache.Get(ip)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	cache := newIPCache(100, 5*time.Minute)
+	cache.Set(netip.MustParsePrefix("1.1.1.0/24"), "AU")
+	cache.SetWithTTL(netip.MustParsePrefix("9.9.9.0/24"), "", 100*time.Millisecond)
+
+	if v, found := cache.Get(netip.MustParseAddr("9.9.9.9")); !found || v != "" {
+		t.Errorf("expected cached miss, got (%q, %v)", v, found)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, found := cache.Get(netip.MustParseAddr("9.9.9.9")); found {
+		t.Error("expected negative entry to expire")
+	}
+	if _, found := cache.Get(netip.MustParseAddr("1.1.1.1")); !found {
+		t.Error("expected positive entry to outlive the negative TTL")
+	}
+}
+
+func TestCacheMaxMemory(t *testing.T) {
+	cache := NewCache[string, string](0, 5*time.Minute, WithMaxMemory(2000))
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprint("key", i), "中国|0|江苏省|南京市|电信")
+	}
+	if got := cache.Bytes(); got <= 0 || got > 2000 {
+		t.Errorf("Bytes() = %d, want within (0, 2000]", got)
+	}
+	if n := cache.Len(); n == 0 || n == 100 {
+		t.Errorf("Len() = %d, expected eviction to keep some but not all entries", n)
+	}
+	if _, found := cache.Get("key99"); !found {
+		t.Error("expected the newest entry to be stored")
+	}
+
+	// Replacing a value adjusts the byte count instead of adding to it.
+	before := cache.Bytes()
+	cache.Set("key99", "中国|0|江苏省|南京市|电信")
+	if got := cache.Bytes(); got != before {
+		t.Errorf("Bytes() after overwrite = %d, want %d", got, before)
+	}
+
+	// An entry larger than the whole budget is not cached.
+	cache.Set("huge", strings.Repeat("x", 4000))
+	if _, found := cache.Get("huge"); found {
+		t.Error("expected oversized entry to be rejected")
+	}
+}
+
+func TestCacheShards(t *testing.T) {
+	cache := newIPCache(1600, 5*time.Minute, WithShards(16))
+	for i := 0; i < 100; i++ {
+		cache.Set(hostPrefix(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})), fmt.Sprint(i))
+	}
+	for i := 0; i < 100; i++ {
+		got, found := cache.Get(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}))
+		if !found || got != fmt.Sprint(i) {
+			t.Errorf("Get(10.0.0.%d) = (%q, %v), want (%q, true)", i, got, found, fmt.Sprint(i))
+		}
+	}
+
+	// The size budget is split across shards but never below one per shard.
+	tiny := NewCache[int, int](2, time.Minute, WithShards(8))
+	if len(tiny.shards) != 8 || tiny.shards[0].maxSize != 1 {
+		t.Errorf("got %d shards of size %d, want 8 of size 1", len(tiny.shards), tiny.shards[0].maxSize)
+	}
+}
+
+func TestCacheEvictionPolicies(t *testing.T) {
+	a, b, c := netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("2.2.2.2"), netip.MustParseAddr("3.3.3.3")
+
+	t.Run("lru evicts least recently used", func(t *testing.T) {
+		cache := newIPCache(2, 5*time.Minute, WithEvictionPolicy(evictLRU))
+		cache.Set(hostPrefix(a), "A")
+		cache.Set(hostPrefix(b), "B")
+		cache.Get(a) // b is now least recently used
+		cache.Set(hostPrefix(c), "C")
+
+		if _, found := cache.Get(b); found {
+			t.Error("expected 2.2.2.2 to be evicted")
+		}
+		if _, found := cache.Get(a); !found {
+			t.Error("expected recently used 1.1.1.1 to stay")
+		}
+		if _, found := cache.Get(c); !found {
+			t.Error("expected 3.3.3.3 to be stored")
 		}
 	})
+
+	t.Run("tinylfu keeps hot entries over one-off keys", func(t *testing.T) {
+		cache := newIPCache(2, 5*time.Minute, WithEvictionPolicy(evictTinyLFU))
+		cache.Set(hostPrefix(a), "A")
+		cache.Set(hostPrefix(b), "B")
+		for i := 0; i < 10; i++ {
+			cache.Get(a)
+			cache.Get(b)
+		}
+
+		// A scanner touching each new address once must not displace them.
+		for i := 0; i < 100; i++ {
+			ip := netip.AddrFrom4([4]byte{203, 0, byte(i / 256), byte(i % 256)})
+			cache.Get(ip)
+			cache.Set(hostPrefix(ip), "X")
+		}
+		if _, found := cache.Get(a); !found {
+			t.Error("expected hot 1.1.1.1 to survive the scan")
+		}
+		if _, found := cache.Get(b); !found {
+			t.Error("expected hot 2.2.2.2 to survive the scan")
+		}
+	})
+}
+
+func TestPrefixCacheNetworkHit(t *testing.T) {
+	cache := newIPCache(100, 5*time.Minute)
+
+	cache.Set(netip.MustParsePrefix("114.114.0.0/16"), "CN")
+	cache.Set(netip.MustParsePrefix("114.114.114.0/24"), "HK")
+	cache.Set(netip.MustParsePrefix("2408:8000::/20"), "CN")
+
+	tests := []struct {
+		ip    string
+		want  string
+		found bool
+	}{
+		{"114.114.1.1", "CN", true},
+		{"114.114.114.114", "HK", true}, // most specific network wins
+		{"114.115.0.1", "", false},
+		{"2408:8000::1", "CN", true},
+		{"2408:9000::1", "", false},
+	}
+	for _, tt := range tests {
+		got, found := cache.Get(netip.MustParseAddr(tt.ip))
+		if found != tt.found || got != tt.want {
+			t.Errorf("Get(%s) = (%q, %v), want (%q, %v)", tt.ip, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestCachePoolReuseAndSnapshot(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "cache.gob")
+	key := cachePoolKey("geocn", CacheConfig{CachePersist: true}, "test-source")
+	create := func() *ipCache { return newIPCache(100, 5*time.Minute) }
+
+	first, err := acquireCache(key, snapshot, zap.NewNop(), create)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	first.Set(netip.MustParsePrefix("114.114.0.0/16"), "CN")
+
+	// A reloaded instance with the same settings shares the warm cache.
+	second, err := acquireCache(key, snapshot, zap.NewNop(), create)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if second != first {
+		t.Fatal("expected the same cache for an unchanged config")
+	}
+	if err := releaseCache(key); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if err := releaseCache(key); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	// The last release wrote a snapshot that a fresh start restores.
+	restored, err := acquireCache(key, snapshot, zap.NewNop(), create)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer releaseCache(key)
+	if restored == first {
+		t.Fatal("expected a new cache after the last release")
+	}
+	if v, found := restored.Get(netip.MustParseAddr("114.114.114.114")); !found || v != "CN" {
+		t.Errorf("restored Get = (%q, %v), want (CN, true)", v, found)
+	}
+
+	// Snapshots from other settings are ignored.
+	otherKey := cachePoolKey("geocn", CacheConfig{CachePersist: true}, "other-source")
+	other, err := acquireCache(otherKey, snapshot, zap.NewNop(), create)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer releaseCache(otherKey)
+	if other.Len() != 0 {
+		t.Errorf("expected snapshot with a different key to be ignored, got %d entries", other.Len())
+	}
+}
+
+func TestCacheSnapshotTiedToDatabaseContent(t *testing.T) {
+	cacheDir := t.TempDir()
+	reader, err := geoip2.Open(fixturePath(t, "Country.mmdb"))
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	t.Cleanup(func() { reader.Close() })
+
+	enabled := true
+	start := func(content string) *GeoCNApp {
+		app := &GeoCNApp{
+			Source: "test-source",
+			CacheConfig: CacheConfig{
+				EnableCache:  &enabled,
+				CacheMaxSize: 100,
+				CacheTTL:     caddy.Duration(time.Minute),
+				CachePersist: true,
+			},
+			ctx:    newTestContext(),
+			db:     new(dbHolder[*geoip2.Reader]),
+			logger: zap.NewNop(),
+		}
+		app.db.swap(reader, content, func() {}, nil)
+		if err := app.startCache(cacheDir); err != nil {
+			t.Fatalf("startCache: %v", err)
+		}
+		return app
+	}
+	addr := netip.MustParseAddr("114.114.114.114")
+
+	app := start("content-1")
+	app.cache.Set(netip.MustParsePrefix("114.114.0.0/16"), "CN")
+	if err := app.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	// A restart on a newer database must not serve the old entries.
+	app = start("content-2")
+	if _, found := app.cache.Get(addr); found {
+		t.Error("restored an entry derived from a different database")
+	}
+	app.cache.Set(netip.MustParsePrefix("114.114.0.0/16"), "CN")
+	if err := app.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	// A restart on the same database restores its entries.
+	app = start("content-2")
+	defer app.Stop()
+	if v, found := app.cache.Get(addr); !found || v != "CN" {
+		t.Errorf("restored Get = (%q, %v), want (CN, true)", v, found)
+	}
 }
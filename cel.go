@@ -0,0 +1,107 @@
+package geocn
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+var (
+	_ caddyhttp.CELLibraryProducer = (*GeoCN)(nil)
+	_ caddyhttp.CELLibraryProducer = (*GeoCity)(nil)
+)
+
+// CELLibrary implements caddyhttp.CELLibraryProducer. It adds
+// geo_country(ip) to expression matchers, returning the ISO country code
+// from the geocn app, e.g.
+//
+//	expression geo_country({client_ip}) in ['CN', 'HK']
+func (m *GeoCN) CELLibrary(ctx caddy.Context) (cel.Library, error) {
+	return caddyhttp.NewMatcherCELLibrary(celCountryFunctions(lazyApp[*GeoCNApp](ctx, "geocn")), nil), nil
+}
+
+// CELLibrary implements caddyhttp.CELLibraryProducer. It adds
+// geo_region(ip), returning the full region string from the geocity app,
+// and geo_province(ip), geo_city(ip) and geo_isp(ip) for its fields.
+func (g *GeoCity) CELLibrary(ctx caddy.Context) (cel.Library, error) {
+	return caddyhttp.NewMatcherCELLibrary(celRegionFunctions(lazyApp[*GeoCityApp](ctx, "geocity")), nil), nil
+}
+
+// celCountryFunctions declares the geocn CEL functions on top of app.
+func celCountryFunctions(app func() (*GeoCNApp, error)) []cel.EnvOption {
+	return []cel.EnvOption{
+		celGeoFunction("geo_country", func(ip string) (string, error) {
+			a, err := app()
+			if err != nil {
+				return "", err
+			}
+			return a.lookupCountry(getHost(ip)), nil
+		}),
+	}
+}
+
+// celRegionFunctions declares the geocity CEL functions on top of app.
+func celRegionFunctions(app func() (*GeoCityApp, error)) []cel.EnvOption {
+	region := func(ip string) (string, error) {
+		a, err := app()
+		if err != nil {
+			return "", err
+		}
+		return a.lookupRegion(getHost(ip)), nil
+	}
+	field := func(get func(regionInfo) string) func(string) (string, error) {
+		return func(ip string) (string, error) {
+			r, err := region(ip)
+			return get(parseRegion(r)), err
+		}
+	}
+	return []cel.EnvOption{
+		celGeoFunction("geo_region", region),
+		celGeoFunction("geo_province", field(func(r regionInfo) string { return r.Province })),
+		celGeoFunction("geo_city", field(func(r regionInfo) string { return r.City })),
+		celGeoFunction("geo_isp", field(func(r regionInfo) string { return r.ISP })),
+	}
+}
+
+// celGeoFunction declares the CEL function name(string) string backed by
+// lookup. Lookup errors make the expression fail to evaluate.
+func celGeoFunction(name string, lookup func(ip string) (string, error)) cel.EnvOption {
+	return cel.Function(name,
+		cel.Overload(name+"_string", []*cel.Type{cel.StringType}, cel.StringType,
+			cel.UnaryBinding(func(arg ref.Val) ref.Val {
+				ip, ok := arg.Value().(string)
+				if !ok {
+					return types.MaybeNoSuchOverloadErr(arg)
+				}
+				v, err := lookup(ip)
+				if err != nil {
+					return types.WrapErr(err)
+				}
+				return types.String(v)
+			})))
+}
+
+// lazyApp resolves the named app on first use. Expression matchers are
+// provisioned whether or not they call the geo functions, so loading the
+// app eagerly would start it (and download its database) for every config
+// with an expression matcher; by request time every app the config uses
+// has been loaded.
+func lazyApp[T any](ctx caddy.Context, name string) func() (T, error) {
+	return sync.OnceValues(func() (T, error) {
+		var zero T
+		appModule, err := ctx.AppIfConfigured(name)
+		if err != nil {
+			return zero, fmt.Errorf("%s app is not configured: %w", name, err)
+		}
+		app, ok := appModule.(T)
+		if !ok {
+			return zero, fmt.Errorf("%s app has wrong type", name)
+		}
+		return app, nil
+	})
+}
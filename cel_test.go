@@ -0,0 +1,89 @@
+package geocn
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+func TestCELGeoFunctions(t *testing.T) {
+	cn, city := newTestGeoCNApp(t), newTestGeoCityApp(t)
+	opts := append(celCountryFunctions(func() (*GeoCNApp, error) { return cn, nil }),
+		celRegionFunctions(func() (*GeoCityApp, error) { return city, nil })...)
+	opts = append(opts, cel.Variable("ip", cel.StringType))
+	env, err := cel.NewEnv(opts...)
+	if err != nil {
+		t.Fatalf("NewEnv: %v", err)
+	}
+
+	eval := func(expr, ip string) ref.Val {
+		t.Helper()
+		ast, iss := env.Compile(expr)
+		if iss.Err() != nil {
+			t.Fatalf("Compile(%q): %v", expr, iss.Err())
+		}
+		prg, err := env.Program(ast)
+		if err != nil {
+			t.Fatalf("Program: %v", err)
+		}
+		out, _, err := prg.Eval(map[string]any{"ip": ip})
+		if err != nil {
+			t.Fatalf("Eval(%q): %v", expr, err)
+		}
+		return out
+	}
+
+	rule := `geo_country(ip) in ['CN', 'HK'] && geo_province(ip) == '江苏省'`
+	if got := eval(rule, "114.114.114.114:443"); got != types.True {
+		t.Errorf("%s for 114.114.114.114 = %v, want true", rule, got)
+	}
+	if got := eval(rule, "8.8.8.8"); got != types.False {
+		t.Errorf("%s for 8.8.8.8 = %v, want false", rule, got)
+	}
+	if got := eval(`geo_city(ip) + '/' + geo_isp(ip)`, "114.114.114.114"); got != types.String("南京市/电信") {
+		t.Errorf("geo_city/geo_isp = %v", got)
+	}
+	if got := eval(`geo_region(ip)`, "8.8.8.8"); got != types.String("美国|0|0|0|Level3") {
+		t.Errorf("geo_region = %v", got)
+	}
+}
+
+func TestCELGeoFunctionsWithoutApp(t *testing.T) {
+	app := lazyApp[*GeoCNApp](newTestContext(), "geocn")
+	env, err := cel.NewEnv(celCountryFunctions(app)...)
+	if err != nil {
+		t.Fatalf("NewEnv: %v", err)
+	}
+	ast, iss := env.Compile(`geo_country('1.1.1.1') == 'CN'`)
+	if iss.Err() != nil {
+		t.Fatalf("Compile: %v", iss.Err())
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		t.Fatalf("Program: %v", err)
+	}
+	if _, _, err := prg.Eval(cel.NoVars()); err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Errorf("expected an app not configured error, got %v", err)
+	}
+}
+
+func TestCELGeoFunctionsInExpressionMatcher(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for _, expr := range []string{
+		`geo_country({client_ip}) in ['CN', 'HK'] && {path}.startsWith('/api')`,
+		`geo_province({client_ip}) == '广东省' || geo_isp({client_ip}) == '电信'`,
+	} {
+		m := &caddyhttp.MatchExpression{Expr: expr}
+		if err := m.Provision(ctx); err != nil {
+			t.Errorf("Provision(%q): %v", expr, err)
+		}
+	}
+}
@@ -2,20 +2,23 @@ package geocn
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 )
 
 // getHost extracts the host part from an address string (may be IP or host:port).
@@ -32,7 +35,9 @@ func isHTTPSource(source string) bool {
 	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
 }
 
-// copyFile copies a file from src to dst.
+// copyFile copies a file from src to dst. The copy is written to a
+// temporary file and renamed into place, so readers that memory-mapped or
+// hold open the previous dst keep seeing intact data.
 func copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
 	if err != nil {
@@ -40,21 +45,25 @@ func copyFile(src, dst string) error {
 	}
 	defer sourceFile.Close()
 
-	destFile, err := os.Create(dst)
+	destFile, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".copy.*")
 	if err != nil {
 		return err
 	}
-	defer destFile.Close()
+	tempFile := destFile.Name()
+	defer os.Remove(tempFile)
 
 	if _, err = io.Copy(destFile, sourceFile); err != nil {
-		os.Remove(dst)
+		destFile.Close()
 		return err
 	}
 	if err = destFile.Sync(); err != nil {
-		os.Remove(dst)
+		destFile.Close()
 		return err
 	}
-	return nil
+	if err = destFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, dst)
 }
 
 // downloadFile downloads a file from remoteURL to localFile using the provided HTTP client.
@@ -179,110 +188,458 @@ func getContextWithTimeout(ctx context.Context, timeout caddy.Duration) (context
 	return context.WithCancel(ctx)
 }
 
-// Generic cache implementation
+// globallyReachable marks registry entries that carve a globally reachable
+// block out of a larger special-purpose one.
+const globallyReachable = "globally reachable"
+
+// specialPurposeRanges holds the IANA IPv4 and IPv6 special-purpose address
+// registries, plus multicast, limited to blocks that are not globally
+// reachable and therefore never carry a meaningful location. Transition
+// prefixes that embed an IPv4 address are unwrapped by unwrapIPv4 instead.
+var specialPurposeRanges = newSpecialPurposeTable(map[string]string{
+	// IPv4, RFC 6890 and updates
+	"0.0.0.0/8":          "this network",
+	"10.0.0.0/8":         "private-use",
+	"100.64.0.0/10":      "shared address space (CGNAT)",
+	"127.0.0.0/8":        "loopback",
+	"169.254.0.0/16":     "link local",
+	"172.16.0.0/12":      "private-use",
+	"192.0.0.0/24":       "IETF protocol assignments",
+	"192.0.0.9/32":       globallyReachable, // PCP anycast
+	"192.0.0.10/32":      globallyReachable, // TURN anycast
+	"192.0.2.0/24":       "documentation (TEST-NET-1)",
+	"192.88.99.0/24":     "deprecated 6to4 relay anycast",
+	"192.168.0.0/16":     "private-use",
+	"198.18.0.0/15":      "benchmarking",
+	"198.51.100.0/24":    "documentation (TEST-NET-2)",
+	"203.0.113.0/24":     "documentation (TEST-NET-3)",
+	"224.0.0.0/4":        "multicast",
+	"240.0.0.0/4":        "reserved",
+	"255.255.255.255/32": "limited broadcast",
+
+	// IPv6
+	"::/128":          "unspecified",
+	"::1/128":         "loopback",
+	"::ffff:0:0/96":   "IPv4-mapped",
+	"64:ff9b:1::/48":  "IPv4-IPv6 local-use translation",
+	"100::/64":        "discard-only",
+	"2001::/23":       "IETF protocol assignments",
+	"2001:1::1/128":   globallyReachable, // PCP anycast
+	"2001:1::2/128":   globallyReachable, // TURN anycast
+	"2001:3::/32":     globallyReachable, // AMT
+	"2001:4:112::/48": globallyReachable, // AS112-v6
+	"2001:db8::/32":   "documentation",
+	"3fff::/20":       "documentation",
+	"5f00::/16":       "segment routing SIDs",
+	"fc00::/7":        "unique local",
+	"fe80::/10":       "link local",
+	"ff00::/8":        "multicast",
+})
+
+func newSpecialPurposeTable(ranges map[string]string) *prefixTable {
+	table := new(prefixTable)
+	for cidr, name := range ranges {
+		table.insert(netip.MustParsePrefix(cidr), name)
+	}
+	return table
+}
 
-// Cache is a generic TTL cache with LRU eviction.
-type Cache[T any] struct {
-	mu      sync.RWMutex
-	entries map[string]*cacheEntry[T]
-	maxSize int
-	ttl     time.Duration
+// checkPrivateAddr returns true if the address belongs to a special-purpose
+// block that is not globally reachable: private, CGNAT, loopback, link-local,
+// documentation, benchmarking, multicast, reserved, and so on.
+func checkPrivateAddr(addr netip.Addr) bool {
+	name, ok := specialPurposeRanges.lookup(addr.Unmap())
+	return ok && name != globallyReachable
 }
 
-type cacheEntry[T any] struct {
-	value     T
-	timestamp time.Time
+// Transition prefixes that carry an IPv4 address inside an IPv6 one.
+var (
+	nat64WellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFourPrefix      = netip.MustParsePrefix("2002::/16")
+	teredoPrefix         = netip.MustParsePrefix("2001::/32")
+)
+
+// addrNormalizer turns a client address into the canonical form used both
+// for lookups and as the cache key, so one client occupies one cache entry
+// whichever way its address was written.
+type addrNormalizer struct {
+	nat64 []netip.Prefix // site-specific NAT64 prefixes (RFC 6052), longest first
 }
 
-// NewCache creates a new cache with the given max size and TTL.
-func NewCache[T any](maxSize int, ttl time.Duration) *Cache[T] {
-	return &Cache[T]{
-		entries: make(map[string]*cacheEntry[T]),
-		maxSize: maxSize,
-		ttl:     ttl,
+// newAddrNormalizer validates the configured NAT64 prefixes. The well-known
+// prefix 64:ff9b::/96 is always recognized and need not be listed.
+func newAddrNormalizer(nat64Prefixes []string) (*addrNormalizer, error) {
+	n := new(addrNormalizer)
+	for _, s := range nat64Prefixes {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NAT64 prefix %q: %w", s, err)
+		}
+		if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			return nil, fmt.Errorf("NAT64 prefix %s must be IPv6", s)
+		}
+		switch prefix.Bits() {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return nil, fmt.Errorf("NAT64 prefix %s must be /32, /40, /48, /56, /64 or /96", s)
+		}
+		n.nat64 = append(n.nat64, prefix.Masked())
 	}
+	// Most specific prefix first, so nested prefixes resolve correctly.
+	slices.SortFunc(n.nat64, func(a, b netip.Prefix) int { return b.Bits() - a.Bits() })
+	return n, nil
 }
 
-// Get retrieves a value from the cache. Returns the value and whether it was found.
-func (c *Cache[T]) Get(key string) (T, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// normalize parses host and returns the address to look up: zone removed,
+// embedded IPv4 addresses unwrapped. ok is false if host is not an IP.
+func (n *addrNormalizer) normalize(host string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !addr.IsValid() {
+		return netip.Addr{}, false
+	}
+	addr = addr.WithZone("")
+	if n != nil && addr.Is6() {
+		for _, prefix := range n.nat64 {
+			if prefix.Contains(addr) {
+				return extractNAT64(addr, prefix.Bits()), true
+			}
+		}
+	}
+	return unwrapIPv4(addr), true
+}
 
-	entry, exists := c.entries[key]
-	if !exists || time.Since(entry.timestamp) > c.ttl {
-		var zero T
-		return zero, false
+// extractNAT64 returns the IPv4 address embedded after a NAT64 prefix of
+// the given length, skipping the reserved "u" octet (RFC 6052 section 2.2).
+func extractNAT64(addr netip.Addr, bits int) netip.Addr {
+	b := addr.As16()
+	var v4 [4]byte
+	i := 0
+	for pos := bits / 8; i < len(v4); pos++ {
+		if pos == 8 {
+			continue
+		}
+		v4[i] = b[pos]
+		i++
 	}
-	return entry.value, true
+	return netip.AddrFrom4(v4)
 }
 
-// Set stores a value in the cache.
-func (c *Cache[T]) Set(key string, value T) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// unwrapIPv4 returns the IPv4 address embedded in IPv4-mapped, NAT64
+// well-known prefix, 6to4 and Teredo addresses, so that lookups and the
+// private address check see the real client. Other addresses are returned
+// unchanged.
+func unwrapIPv4(addr netip.Addr) netip.Addr {
+	if addr.Is4In6() {
+		return addr.Unmap()
+	}
+	if !addr.Is6() {
+		return addr
+	}
+	b := addr.As16()
+	switch {
+	case nat64WellKnownPrefix.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[12:16]))
+	case sixToFourPrefix.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[2:6]))
+	case teredoPrefix.Contains(addr):
+		// RFC 4380: the client's public address is stored inverted.
+		return netip.AddrFrom4([4]byte{^b[12], ^b[13], ^b[14], ^b[15]})
+	}
+	return addr
+}
 
-	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxSize {
-		c.evictOne()
+// Values accepted by the private_ips option besides a fixed country or region.
+const (
+	privateIPsNoMatch = "no_match"
+	privateIPsMatch   = "match"
+)
+
+// privatePolicy decides how internal addresses are resolved: those rejected by
+// checkPrivateAddr plus any user-defined private ranges.
+type privatePolicy struct {
+	mode   string // no_match, match, or a fixed country/region
+	ranges prefixTable
+}
+
+// newPrivatePolicy builds a policy from the private_ips mode and the
+// private_ranges map of fixed value to CIDR list. validValue checks fixed
+// values, so that a misspelled mode is not taken for one.
+func newPrivatePolicy(mode string, ranges map[string][]string, validValue func(string) error) (*privatePolicy, error) {
+	switch mode {
+	case "":
+		mode = privateIPsNoMatch
+	case privateIPsNoMatch, privateIPsMatch:
+	default:
+		if err := validValue(mode); err != nil {
+			return nil, fmt.Errorf("invalid private_ips %q: want %s, %s or %w", mode, privateIPsNoMatch, privateIPsMatch, err)
+		}
 	}
+	p := &privatePolicy{mode: mode}
+	for value, cidrs := range ranges {
+		if err := validValue(value); err != nil {
+			return nil, fmt.Errorf("invalid private range value %q: want %w", value, err)
+		}
+		for _, cidr := range cidrs {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid private range %q: %w", cidr, err)
+			}
+			p.ranges.insert(prefix, value)
+		}
+	}
+	return p, nil
+}
 
-	c.entries[key] = &cacheEntry[T]{
-		value:     value,
-		timestamp: time.Now(),
+// resolve returns the value for an internal address; ok is false for public
+// addresses, which should be looked up in the database. matchValue is the
+// value reported for the "match" mode.
+func (p *privatePolicy) resolve(addr netip.Addr, matchValue string) (string, bool) {
+	if p == nil {
+		return "", checkPrivateAddr(addr)
+	}
+	if value, ok := p.ranges.lookup(addr); ok {
+		return value, true
+	}
+	if !checkPrivateAddr(addr) {
+		return "", false
+	}
+	switch p.mode {
+	case privateIPsNoMatch:
+		return "", true
+	case privateIPsMatch:
+		return matchValue, true
+	default:
+		return p.mode, true
 	}
 }
 
-// evictOne removes one random entry from the cache.
-// For IP geo-lookup caches, precise LRU ordering is unnecessary;
-// random eviction is O(1) and avoids the O(n) full-table scan.
-func (c *Cache[T]) evictOne() {
-	for key := range c.entries {
-		delete(c.entries, key)
-		return
+// unresolved reports whether addr is a special-purpose address that the
+// policy leaves without a location: private_ips is no_match and no
+// private range covers it.
+func (p *privatePolicy) unresolved(addr netip.Addr) bool {
+	if !checkPrivateAddr(addr) {
+		return false
+	}
+	if p == nil {
+		return true
+	}
+	if _, ok := p.ranges.lookup(addr); ok {
+		return false
 	}
+	return p.mode == privateIPsNoMatch
 }
 
-// Cleanup removes expired entries periodically until context is done.
-// Uses two-phase cleanup to minimize lock contention.
-func (c *Cache[T]) Cleanup(ctx context.Context) {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+// validCountryCode accepts the fixed values of the geocn app: ISO 3166-1
+// alpha-2 codes as the database reports them.
+func validCountryCode(v string) error {
+	if len(v) != 2 || !isUpperLetters(v) {
+		return errors.New("an upper-case two-letter country code")
+	}
+	return nil
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			// Phase 1: Collect expired keys with read lock
-			c.mu.RLock()
-			now := time.Now()
-			var keysToDelete []string
-			for key, entry := range c.entries {
-				if now.Sub(entry.timestamp) > c.ttl {
-					keysToDelete = append(keysToDelete, key)
-				}
-			}
-			c.mu.RUnlock()
-
-			// Phase 2: Delete expired entries with write lock
-			if len(keysToDelete) > 0 {
-				c.mu.Lock()
-				now = time.Now()
-				for _, key := range keysToDelete {
-					// Re-check to avoid deleting entries updated between phases
-					if entry, exists := c.entries[key]; exists && now.Sub(entry.timestamp) > c.ttl {
-						delete(c.entries, key)
-					}
-				}
-				c.mu.Unlock()
-			}
-		case <-ctx.Done():
-			return
+func isUpperLetters(v string) bool {
+	for _, c := range v {
+		if c < 'A' || c > 'Z' {
+			return false
 		}
 	}
+	return true
 }
 
-// checkPrivateAddr returns true if the address is private, loopback, multicast, or unspecified.
-func checkPrivateAddr(addr netip.Addr) bool {
-	return addr.IsLoopback() || addr.IsLinkLocalMulticast() || addr.IsLinkLocalUnicast() ||
-		addr.IsPrivate() || addr.IsUnspecified() || addr.IsMulticast()
+// validRegion accepts the fixed values of the geocity app: region strings
+// in the ip2region format.
+func validRegion(v string) error {
+	if strings.Count(v, "|") != 4 {
+		return errors.New("a region string like 国家|区域|省份|城市|ISP")
+	}
+	return nil
+}
+
+// matchesAll reports whether addr is internal and the mode is "match",
+// i.e. matchers should accept it regardless of their own criteria.
+func (p *privatePolicy) matchesAll(addr netip.Addr) bool {
+	if p == nil || p.mode != privateIPsMatch {
+		return false
+	}
+	if _, ok := p.ranges.lookup(addr); ok {
+		return false
+	}
+	return checkPrivateAddr(addr)
+}
+
+// prefixTable resolves addresses to values by longest-prefix match.
+// Lookups probe one map entry per distinct prefix length in the table.
+type prefixTable struct {
+	entries map[netip.Prefix]string
+	bits    []int // distinct prefix lengths, longest first
+}
+
+// insert adds or replaces the value for prefix.
+func (t *prefixTable) insert(prefix netip.Prefix, value string) {
+	if t.entries == nil {
+		t.entries = make(map[netip.Prefix]string)
+	}
+	prefix = prefix.Masked()
+	t.entries[prefix] = value
+	if !slices.Contains(t.bits, prefix.Bits()) {
+		t.bits = append(t.bits, prefix.Bits())
+		slices.SortFunc(t.bits, func(a, b int) int { return b - a })
+	}
+}
+
+// lookup returns the value of the longest prefix containing addr.
+func (t *prefixTable) lookup(addr netip.Addr) (string, bool) {
+	if len(t.entries) == 0 {
+		return "", false
+	}
+	for _, bits := range t.bits {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if value, ok := t.entries[prefix]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// parsePrivateRange parses "private_range <value> <cidr> [<cidr>...]".
+func parsePrivateRange(d *caddyfile.Dispenser, ranges *map[string][]string) error {
+	args := d.RemainingArgs()
+	if len(args) < 2 {
+		return d.ArgErr()
+	}
+	for _, cidr := range args[1:] {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return d.Errf("invalid private range %s: %v", cidr, err)
+		}
+	}
+	if *ranges == nil {
+		*ranges = make(map[string][]string)
+	}
+	(*ranges)[args[0]] = append((*ranges)[args[0]], args[1:]...)
+	return nil
+}
+
+// geoLocator resolves client locations for modules built on the geo apps.
+// Either app may be nil when the module's configuration does not need it.
+type geoLocator struct {
+	cn   *GeoCNApp
+	city *GeoCityApp
+}
+
+// provision loads the geocn app if needCN and the geocity app if needCity.
+func (l *geoLocator) provision(ctx caddy.Context, needCN, needCity bool) error {
+	if needCN {
+		appModule, err := ctx.App("geocn")
+		if err != nil {
+			return fmt.Errorf("failed to get geocn app: %w", err)
+		}
+		var ok bool
+		if l.cn, ok = appModule.(*GeoCNApp); !ok {
+			return fmt.Errorf("geocn app has wrong type")
+		}
+	}
+	if needCity {
+		appModule, err := ctx.App("geocity")
+		if err != nil {
+			return fmt.Errorf("failed to get geocity app: %w", err)
+		}
+		var ok bool
+		if l.city, ok = appModule.(*GeoCityApp); !ok {
+			return fmt.Errorf("geocity app has wrong type")
+		}
+	}
+	return nil
+}
+
+// Request variables holding lookup results, so that matchers and handlers
+// resolving the same request share one lookup. They are also readable as
+// {http.vars.geocn.country} and {http.vars.geocity.region}.
+const (
+	countryVarKey = "geocn.country"
+	regionVarKey  = "geocity.region"
+)
+
+// location is where geoLocator placed an address. Each part is empty when
+// its app is not loaded or has no data for the address.
+type location struct {
+	country string
+	region  string
+	// anyRegion is set for internal addresses under the geocity app's
+	// private_ips "match" mode: they have no region string but, as with the
+	// geocity matcher, every region keyword accepts them.
+	anyRegion bool
+}
+
+// known reports whether anything is known about the location.
+func (loc location) known() bool {
+	return loc.country != "" || loc.region != "" || loc.anyRegion
+}
+
+// matchRegion reports whether the location matches any of the geocity
+// keywords.
+func (loc location) matchRegion(keywords []string) bool {
+	if len(keywords) == 0 {
+		return false
+	}
+	return loc.anyRegion || loc.region != "" && matchRegionKeywords(keywords, loc.region)
+}
+
+// match reports whether the location is in one of countries or matches
+// one of the region keywords. Keywords have the same "+" (AND) semantics
+// as the geocity matcher and apply to the full region string.
+func (loc location) match(countries, regions []string) bool {
+	if loc.country != "" && slices.Contains(countries, loc.country) {
+		return true
+	}
+	return loc.matchRegion(regions)
+}
+
+// locate returns the location of the client of r.
+func (l *geoLocator) locate(r *http.Request) location {
+	host, _ := extractClientIP(r)
+	if host == "" {
+		return location{}
+	}
+	var loc location
+	if l.cn != nil {
+		loc.country = lookupOnce(r, countryVarKey, host, l.cn.lookupCountry)
+	}
+	if l.city != nil {
+		loc.region = lookupOnce(r, regionVarKey, host, l.city.lookupRegion)
+		loc.anyRegion = loc.region == "" && l.city.matchesPrivate(host)
+	}
+	return loc
+}
+
+// locateHost returns the location of host. Unlike locate, results are not
+// stored as request variables, since host is not the client of the
+// request.
+func (l *geoLocator) locateHost(host string) location {
+	var loc location
+	if l.cn != nil {
+		loc.country = l.cn.lookupCountry(host)
+	}
+	if l.city != nil {
+		loc.region = l.city.lookupRegion(host)
+		loc.anyRegion = loc.region == "" && l.city.matchesPrivate(host)
+	}
+	return loc
+}
+
+// lookupOnce returns the request variable key if an earlier matcher or
+// handler set it, otherwise it resolves host with lookup and stores the
+// result, empty or not.
+func lookupOnce(r *http.Request, key, host string, lookup func(string) string) string {
+	if v, ok := caddyhttp.GetVar(r.Context(), key).(string); ok {
+		return v
+	}
+	v := lookup(host)
+	caddyhttp.SetVar(r.Context(), key, v)
+	return v
 }
 
 // extractClientIP extracts the client IP host and raw string from an HTTP request.
@@ -294,17 +651,192 @@ func extractClientIP(r *http.Request) (host, raw string) {
 	return getHost(r.RemoteAddr), r.RemoteAddr
 }
 
+// Modes for matching across the X-Forwarded-For chain.
+const (
+	chainAny   = "any"
+	chainAll   = "all"
+	chainFirst = "first"
+	chainLast  = "last"
+)
+
+// forwardedChain returns the hops a request passed through: the
+// X-Forwarded-For entries, original client first, followed by the address
+// of the peer that connected to us unless Caddy trusts it as a proxy.
+// Entries that are not IPs, and those skip reports as internal, are
+// dropped, so the last hop is the rightmost untrusted one.
+func forwardedChain(r *http.Request, skip func(host string) bool) []string {
+	var hops []string
+	add := func(s string) {
+		addr, err := netip.ParseAddr(getHost(s))
+		if err != nil || skip(addr.String()) {
+			return
+		}
+		hops = append(hops, addr.String())
+	}
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for part := range strings.SplitSeq(v, ",") {
+			add(part)
+		}
+	}
+	if trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool); !trusted {
+		add(r.RemoteAddr)
+	}
+	return hops
+}
+
+// internalHop reports whether host is a special-purpose address that
+// neither the overrides nor the private policy give a location. In a
+// forwarded chain such hops are the proxies in front of Caddy.
+func internalHop(n *addrNormalizer, o *overrides, p *privatePolicy, host string) bool {
+	addr, ok := n.normalize(host)
+	if !ok {
+		return false
+	}
+	if _, ok := o.lookup(addr); ok {
+		return false
+	}
+	return p.unresolved(addr)
+}
+
+// matchChain applies match to hops according to mode. An empty chain
+// never matches.
+func matchChain(mode string, hops []string, match func(host string) bool) bool {
+	if len(hops) == 0 {
+		return false
+	}
+	switch mode {
+	case chainFirst:
+		return match(hops[0])
+	case chainLast:
+		return match(hops[len(hops)-1])
+	case chainAll:
+		for _, h := range hops {
+			if !match(h) {
+				return false
+			}
+		}
+		return true
+	}
+	return slices.ContainsFunc(hops, match)
+}
+
+// Fallbacks when a matcher's source does not yield a valid IP.
+const (
+	sourceFallbackClientIP = "client_ip"
+	sourceFallbackNoMatch  = "no_match"
+)
+
+// ipSource selects the address a matcher geolocates. By default it is the
+// client IP; Source replaces it with a placeholder evaluated per request,
+// such as a header set by a trusted edge or a query parameter.
+type ipSource struct {
+	// Source is a placeholder, e.g. {http.request.header.X-Edge-Client-IP},
+	// resolving to an IP address (optionally with a port). For a
+	// comma-separated list the first entry is used.
+	Source string `json:"source,omitempty"`
+	// SourceFallback applies when Source is empty or not an IP: client_ip
+	// (default) uses the client IP, no_match makes the matcher not match.
+	SourceFallback string `json:"source_fallback,omitempty"`
+	// Chain, if set, geolocates every hop of the X-Forwarded-For chain
+	// instead of one address: any, all, first or last hop must match.
+	// Internal hops without a location and a trusted peer are skipped.
+	// Cannot be combined with Source.
+	Chain string `json:"chain,omitempty"`
+}
+
+func (s *ipSource) validate() error {
+	if s.Source != "" && !strings.Contains(s.Source, "{") {
+		return fmt.Errorf("source must be a placeholder, got %q", s.Source)
+	}
+	switch s.SourceFallback {
+	case "", sourceFallbackClientIP, sourceFallbackNoMatch:
+	default:
+		return fmt.Errorf("unknown source_fallback %q (want client_ip or no_match)", s.SourceFallback)
+	}
+	switch s.Chain {
+	case "", chainAny, chainAll, chainFirst, chainLast:
+	default:
+		return fmt.Errorf("unknown chain mode %q (want any, all, first or last)", s.Chain)
+	}
+	if s.Chain != "" && s.Source != "" {
+		return fmt.Errorf("source and chain are mutually exclusive")
+	}
+	return nil
+}
+
+// resolve returns the host to geolocate for r and the raw value it came
+// from. client reports whether host is the client IP, whose lookups are
+// shared through request variables; host is empty if nothing should match.
+func (s *ipSource) resolve(r *http.Request) (host, raw string, client bool) {
+	if s.Source == "" {
+		host, raw = extractClientIP(r)
+		return host, raw, true
+	}
+
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		raw = repl.ReplaceAll(s.Source, "")
+	}
+	first, _, _ := strings.Cut(raw, ",")
+	if addr, err := netip.ParseAddr(getHost(first)); err == nil {
+		return addr.String(), raw, false
+	}
+
+	if s.SourceFallback == sourceFallbackNoMatch {
+		return "", raw, false
+	}
+	host, raw = extractClientIP(r)
+	return host, raw, true
+}
+
+// lookupSource resolves host with lookup, sharing the result through the
+// request variable key only when host is the client IP.
+func lookupSource(r *http.Request, client bool, key, host string, lookup func(string) string) string {
+	if client {
+		return lookupOnce(r, key, host, lookup)
+	}
+	return lookup(host)
+}
+
+// unmarshalCaddyfile parses the source options in a matcher block. It
+// reports whether the current token was one of them.
+func (s *ipSource) unmarshalCaddyfile(d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "source":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.Source = d.Val()
+	case "source_fallback":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.SourceFallback = d.Val()
+	case "chain":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		s.Chain = d.Val()
+	default:
+		return false, nil
+	}
+	if d.NextArg() {
+		return true, d.ArgErr()
+	}
+	return true, nil
+}
+
 // parseCacheBlock parses the cache directive in a Caddyfile block.
-// It handles "cache off" and "cache ttl <dur> size <n>" syntax.
-func parseCacheBlock(d *caddyfile.Dispenser, enableCache **bool, cacheTTL *caddy.Duration, cacheMaxSize *int) error {
+// It handles "cache off" and
+// "cache ttl <dur> negative_ttl <dur> size <n> max_memory <bytes> policy <name> shards <n> [persist]" syntax.
+func parseCacheBlock(d *caddyfile.Dispenser, cfg *CacheConfig) error {
 	args := d.RemainingArgs()
 	if len(args) > 0 && args[0] == "off" {
 		off := false
-		*enableCache = &off
+		cfg.EnableCache = &off
 		return nil
 	}
 	on := true
-	*enableCache = &on
+	cfg.EnableCache = &on
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
 		case "ttl":
@@ -316,7 +848,20 @@ func parseCacheBlock(d *caddyfile.Dispenser, enableCache **bool, cacheTTL *caddy
 			if err != nil {
 				return err
 			}
-			*cacheTTL = caddy.Duration(val)
+			cfg.CacheTTL = caddy.Duration(val)
+		case "negative_ttl":
+			i++
+			if i >= len(args) {
+				return d.Errf("missing value for cache negative_ttl")
+			}
+			val, err := caddy.ParseDuration(args[i])
+			if err != nil {
+				return err
+			}
+			if val <= 0 {
+				return d.Errf("invalid cache negative_ttl: %s", args[i])
+			}
+			cfg.CacheNegativeTTL = caddy.Duration(val)
 		case "size":
 			i++
 			if i >= len(args) {
@@ -327,8 +872,39 @@ func parseCacheBlock(d *caddyfile.Dispenser, enableCache **bool, cacheTTL *caddy
 				return d.Errf("invalid cache size: %s", args[i])
 			}
 			if maxSize > 0 {
-				*cacheMaxSize = maxSize
+				cfg.CacheMaxSize = maxSize
+			}
+		case "persist":
+			cfg.CachePersist = true
+		case "max_memory":
+			i++
+			if i >= len(args) {
+				return d.Errf("missing value for cache max_memory")
+			}
+			size, err := humanize.ParseBytes(args[i])
+			if err != nil || size == 0 || size > math.MaxInt64 {
+				return d.Errf("invalid cache max_memory: %s", args[i])
+			}
+			cfg.CacheMaxMemory = int64(size)
+		case "shards":
+			i++
+			if i >= len(args) {
+				return d.Errf("missing value for cache shards")
+			}
+			var shards int
+			if _, err := fmt.Sscanf(args[i], "%d", &shards); err != nil || shards < 1 || shards > maxCacheShards {
+				return d.Errf("invalid cache shards: %s", args[i])
+			}
+			cfg.CacheShards = shards
+		case "policy":
+			i++
+			if i >= len(args) {
+				return d.Errf("missing value for cache policy")
+			}
+			if err := checkEvictionPolicy(args[i]); err != nil {
+				return d.Err(err.Error())
 			}
+			cfg.CachePolicy = args[i]
 		default:
 			return d.Errf("unknown cache option: %s", args[i])
 		}
@@ -0,0 +1,267 @@
+package geocn
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestMatcherSource(t *testing.T) {
+	cn := newTestGeoCNApp(t)
+	newRequest := func(edgeIP string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "9.9.9.9:1234" // not in China
+		if edgeIP != "" {
+			r.Header.Set("X-Edge-Client-IP", edgeIP)
+		}
+		repl := caddyhttp.NewTestReplacer(r)
+		return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	}
+
+	m := &GeoCN{
+		ipSource: ipSource{Source: "{http.request.header.X-Edge-Client-IP}"},
+		app:      cn,
+		logger:   zap.NewNop(),
+	}
+	if !m.Match(newRequest("114.114.114.114")) {
+		t.Error("expected the edge-supplied Chinese IP to match")
+	}
+	if !m.Match(newRequest("114.114.114.114, 10.0.0.1")) {
+		t.Error("expected the first entry of a list to be used")
+	}
+	// Missing or invalid values fall back to the client IP by default.
+	if m.Match(newRequest("not-an-ip")) {
+		t.Error("expected fallback to the non-Chinese client IP")
+	}
+
+	r := newRequest("")
+	r.RemoteAddr = "114.114.114.114:1234"
+	if !m.Match(r) {
+		t.Error("expected fallback to the Chinese client IP")
+	}
+	m.SourceFallback = sourceFallbackNoMatch
+	if m.Match(r) {
+		t.Error("expected no match without a usable source under no_match")
+	}
+}
+
+func TestMatcherSourceCaddyfile(t *testing.T) {
+	var m GeoCN
+	err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geocn {
+		source {http.request.uri.query.ip}
+		source_fallback no_match
+	}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.Source != "{http.request.uri.query.ip}" || m.SourceFallback != sourceFallbackNoMatch {
+		t.Errorf("unexpected source config: %+v", m.ipSource)
+	}
+	if err := m.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	if err := (&GeoCN{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geocn`)); err != nil {
+		t.Errorf("bare geocn: %v", err)
+	}
+	if err := (&GeoCN{ipSource: ipSource{Source: "1.2.3.4"}}).Validate(); err == nil {
+		t.Error("expected a constant source to be rejected")
+	}
+
+	var g GeoCity
+	err = g.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geocity {
+		regions 广东
+		source {http.request.header.X-Edge-Client-IP}
+	}`))
+	if err != nil || g.Source != "{http.request.header.X-Edge-Client-IP}" {
+		t.Errorf("geocity source: %+v, %v", g.ipSource, err)
+	}
+}
+
+func TestForwardedChain(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Add("X-Forwarded-For", "114.114.114.114, unknown")
+	r.Header.Add("X-Forwarded-For", "[2001:db8::1]:443")
+	keep := func(string) bool { return false }
+	got := forwardedChain(r, keep)
+	want := []string{"114.114.114.114", "2001:db8::1", "10.0.0.1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("forwardedChain = %v, want %v", got, want)
+	}
+	if got := forwardedChain(r, func(h string) bool { return h == "10.0.0.1" }); !slices.Equal(got, want[:2]) {
+		t.Errorf("forwardedChain skipping internal hops = %v, want %v", got, want[:2])
+	}
+
+	// A peer Caddy trusts as a proxy is not a hop of its own.
+	r.RemoteAddr = "203.0.113.7:1234"
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{
+		caddyhttp.TrustedProxyVarKey: true,
+	}))
+	if got := forwardedChain(r, keep); !slices.Equal(got, want[:2]) {
+		t.Errorf("forwardedChain behind a trusted proxy = %v, want %v", got, want[:2])
+	}
+
+	isOne := func(h string) bool { return h == "1" }
+	for _, tt := range []struct {
+		mode string
+		hops []string
+		want bool
+	}{
+		{chainAny, []string{"2", "1"}, true},
+		{chainAll, []string{"1", "2"}, false},
+		{chainAll, []string{"1", "1"}, true},
+		{chainFirst, []string{"1", "2"}, true},
+		{chainLast, []string{"1", "2"}, false},
+		{chainAny, nil, false},
+		{chainAll, nil, false},
+	} {
+		if got := matchChain(tt.mode, tt.hops, isOne); got != tt.want {
+			t.Errorf("matchChain(%s, %v) = %v, want %v", tt.mode, tt.hops, got, tt.want)
+		}
+	}
+}
+
+func TestMatcherChain(t *testing.T) {
+	cn := newTestGeoCNApp(t)
+	city := newTestGeoCityApp(t)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Forwarded-For", "114.114.114.114, 8.8.8.8")
+	r.RemoteAddr = "114.114.114.114:1234"
+
+	for mode, want := range map[string]bool{
+		chainAny:   true,
+		chainAll:   false,
+		chainFirst: true,
+		chainLast:  true,
+	} {
+		m := &GeoCN{ipSource: ipSource{Chain: mode}, app: cn, logger: zap.NewNop()}
+		if got := m.Match(r); got != want {
+			t.Errorf("geocn chain %s = %v, want %v", mode, got, want)
+		}
+	}
+
+	g := &GeoCity{allKeywords: []string{"江苏"}, ipSource: ipSource{Chain: chainAny}, app: city, logger: zap.NewNop()}
+	if !g.Match(r) {
+		t.Error("expected geocity to match a Jiangsu hop with chain any")
+	}
+	g.Chain = chainAll
+	if g.Match(r) {
+		t.Error("expected geocity not to match the US hop with chain all")
+	}
+}
+
+func TestMatcherChainBehindInternalProxy(t *testing.T) {
+	cn := newTestGeoCNApp(t)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Forwarded-For", "114.114.114.114, 192.168.1.1")
+	r.RemoteAddr = "10.0.0.1:1234"
+
+	// The internal load balancers are skipped, leaving the CN client as
+	// the only and rightmost hop.
+	for _, mode := range []string{chainAll, chainLast} {
+		m := &GeoCN{ipSource: ipSource{Chain: mode}, app: cn, logger: zap.NewNop()}
+		if !m.Match(r) {
+			t.Errorf("geocn chain %s behind an internal proxy did not match", mode)
+		}
+	}
+
+	// A private range gives internal hops a location, so they count again.
+	private, err := newPrivatePolicy(privateIPsNoMatch, map[string][]string{"US": {"10.0.0.0/8"}}, validCountryCode)
+	if err != nil {
+		t.Fatalf("newPrivatePolicy: %v", err)
+	}
+	cn.private = private
+	m := &GeoCN{ipSource: ipSource{Chain: chainLast}, app: cn, logger: zap.NewNop()}
+	if m.Match(r) {
+		t.Error("expected the located internal peer to be the last hop")
+	}
+
+	city := newTestGeoCityApp(t)
+	g := &GeoCity{allKeywords: []string{"江苏"}, ipSource: ipSource{Chain: chainAll}, app: city, logger: zap.NewNop()}
+	if !g.Match(r) {
+		t.Error("expected geocity chain all to match behind an internal proxy")
+	}
+}
+
+func TestMatcherChainCaddyfile(t *testing.T) {
+	var m GeoCN
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geocn {
+		chain all
+	}`)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.Chain != chainAll {
+		t.Errorf("chain = %q, want all", m.Chain)
+	}
+	if err := m.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	if err := (&GeoCN{ipSource: ipSource{Chain: "middle"}}).Validate(); err == nil {
+		t.Error("expected an unknown chain mode to be rejected")
+	}
+	both := ipSource{Source: "{http.request.header.X-Edge-Client-IP}", Chain: chainAny}
+	if err := (&GeoCN{ipSource: both}).Validate(); err == nil {
+		t.Error("expected source and chain together to be rejected")
+	}
+}
+
+func TestLocatePrivateMatch(t *testing.T) {
+	city := newTestGeoCityApp(t)
+	private, err := newPrivatePolicy(privateIPsMatch, nil, validRegion)
+	if err != nil {
+		t.Fatalf("newPrivatePolicy: %v", err)
+	}
+	city.private = private
+	l := geoLocator{city: city}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+	loc := l.locate(r)
+	if !loc.known() || !loc.matchRegion([]string{"广东"}) {
+		t.Errorf("expected an internal client to match region rules under private_ips match: %+v", loc)
+	}
+	if loc.matchRegion(nil) {
+		t.Error("expected no match without region keywords")
+	}
+	if !(GeofenceRules{Regions: []string{"广东"}}).match(loc) {
+		t.Error("expected geofence region rules to accept the internal client")
+	}
+	if !(GeoUpstreamRule{Region: "广东"}).match(l.locateHost("192.168.1.1")) {
+		t.Error("expected geo selection region rules to accept the internal address")
+	}
+	if (GeoUpstreamRule{Region: "广东"}).match(l.locateHost("8.8.8.8")) {
+		t.Error("expected a public address outside the region not to match")
+	}
+}
+
+func TestLocationMatch(t *testing.T) {
+	jiangsu := location{country: "CN", region: "中国|0|江苏省|南京市|电信"}
+	for _, tt := range []struct {
+		loc       location
+		countries []string
+		regions   []string
+		want      bool
+	}{
+		{jiangsu, []string{"CN"}, nil, true},
+		{jiangsu, []string{"US"}, []string{"江苏+电信"}, true},
+		{jiangsu, []string{"US"}, []string{"江苏+联通"}, false},
+		{jiangsu, nil, nil, false},
+		{location{}, []string{""}, nil, false},
+		{location{anyRegion: true}, nil, []string{"广东"}, true},
+		{location{anyRegion: true}, []string{"CN"}, nil, false},
+	} {
+		if got := tt.loc.match(tt.countries, tt.regions); got != tt.want {
+			t.Errorf("%+v.match(%v, %v) = %v, want %v", tt.loc, tt.countries, tt.regions, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package geocn
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// dbPool holds loaded databases across config reloads, keyed by source and
+// file content. A reload whose database is unchanged picks up the reader
+// the previous config already has in memory instead of loading a second
+// copy; the reader is closed once no app instance uses it.
+var dbPool = caddy.NewUsagePool()
+
+// sharedDB is the dbPool value wrapping a loaded reader or searcher.
+type sharedDB struct {
+	db    any
+	close func()
+}
+
+// Destruct implements caddy.Destructor.
+func (s *sharedDB) Destruct() error {
+	s.close()
+	return nil
+}
+
+// fileDBKey returns the dbPool key for the database file at path. The file
+// is hashed in a streaming pass, so an unchanged database is recognised
+// without reading it into memory.
+func fileDBKey(app, source, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s|%s|%x", app, source, h.Sum(nil)), nil
+}
+
+// fileStamp identifies a version of a file by size and modification time,
+// which is far cheaper to check than its fileDBKey.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// changed reports whether the file at path differs from the stamp last
+// recorded in s, and records the current one. Files that cannot be stat'ed
+// count as unchanged.
+func (s *fileStamp) changed(path string) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if fi.Size() == s.size && fi.ModTime().Equal(s.modTime) {
+		return false
+	}
+	s.size, s.modTime = fi.Size(), fi.ModTime()
+	return true
+}
+
+// acquireDB returns the pooled database for key, calling open to load it
+// when no app instance holds it yet. loaded reports whether an existing
+// copy was reused. Each successful call must be paired with releaseDB.
+func acquireDB[T any](key string, open func() (T, func(), error)) (db T, loaded bool, err error) {
+	val, loaded, err := dbPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		db, closeFn, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return &sharedDB{db: db, close: closeFn}, nil
+	})
+	if err != nil {
+		return db, false, err
+	}
+	db, ok := val.(*sharedDB).db.(T)
+	if !ok {
+		dbPool.Delete(key)
+		return db, false, fmt.Errorf("database pool entry %s has wrong type %T", key, val.(*sharedDB).db)
+	}
+	return db, loaded, nil
+}
+
+// releaseDB drops one reference to the pooled database for key.
+func releaseDB(key string) {
+	if key != "" {
+		dbPool.Delete(key)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build geocn_embed
+
+package geocn
+
+import (
+	"embed"
+	"path"
+)
+
+// embeddedFS holds the database snapshots placed in the embedded/ directory
+// at build time. Build with -tags geocn_embed to compile them into the binary.
+//
+//go:embed embedded
+var embeddedFS embed.FS
+
+// bundledDatabase returns the bundled snapshot with the given file name.
+func bundledDatabase(name string) ([]byte, bool) {
+	data, err := embeddedFS.ReadFile(path.Join("embedded", name))
+	if err != nil || len(data) == 0 {
+		return nil, false
+	}
+	return data, true
+}
@@ -0,0 +1,9 @@
+//go:build !geocn_embed
+
+package geocn
+
+// bundledDatabase reports that no snapshot is bundled; build with
+// -tags geocn_embed to enable the embedded fallback databases.
+func bundledDatabase(string) ([]byte, bool) {
+	return nil, false
+}
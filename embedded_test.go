@@ -0,0 +1,95 @@
+package geocn
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
+	geoip2 "github.com/oschwald/geoip2-golang/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// useEmbeddedFixtures serves the repository fixtures as the bundled
+// snapshots for the duration of the test.
+func useEmbeddedFixtures(t *testing.T) {
+	t.Helper()
+	orig := embeddedDatabase
+	embeddedDatabase = func(name string) ([]byte, bool) {
+		data, err := os.ReadFile(fixturePath(t, name))
+		return data, err == nil
+	}
+	t.Cleanup(func() { embeddedDatabase = orig })
+}
+
+// checkFallbackWarning asserts that logs hold one warning about the
+// embedded snapshot, reporting its build time and age.
+func checkFallbackWarning(t *testing.T, logs *observer.ObservedLogs) {
+	t.Helper()
+	entries := logs.FilterMessage("source unavailable, using embedded database snapshot").All()
+	if len(entries) != 1 {
+		t.Fatalf("got %d fallback warnings, want 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	for _, key := range []string{"built", "age", "cause"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("fallback warning lacks %q: %v", key, fields)
+		}
+	}
+}
+
+func TestGeoCNAppLoadDatabaseFallsBackToEmbedded(t *testing.T) {
+	useEmbeddedFixtures(t)
+	core, logs := observer.New(zapcore.WarnLevel)
+
+	tmpDir := t.TempDir()
+	app := &GeoCNApp{
+		Source:    filepath.Join(tmpDir, "missing.mmdb"),
+		localFile: filepath.Join(tmpDir, "Country.mmdb"),
+		ctx:       newTestContext(),
+		db:        new(dbHolder[*geoip2.Reader]),
+		logger:    zap.New(core),
+	}
+	t.Cleanup(func() { app.Cleanup() })
+
+	if err := app.loadDatabase(); err != nil {
+		t.Fatalf("expected embedded fallback, got %v", err)
+	}
+	if got := app.lookupCountry("114.114.114.114"); got != "CN" {
+		t.Errorf("lookupCountry from the embedded snapshot = %q, want CN", got)
+	}
+	checkFallbackWarning(t, logs)
+}
+
+func TestGeoCityAppLoadDatabaseFallsBackToEmbedded(t *testing.T) {
+	useEmbeddedFixtures(t)
+	core, logs := observer.New(zapcore.WarnLevel)
+
+	tmpDir := t.TempDir()
+	app := &GeoCityApp{
+		ctx:    newTestContext(),
+		ipv4DB: new(dbHolder[*xdbSearcher]),
+		ipv6DB: new(dbHolder[*xdbSearcher]),
+		logger: zap.New(core),
+	}
+	t.Cleanup(func() { app.Cleanup() })
+
+	source := filepath.Join(tmpDir, "missing.xdb")
+	if err := app.loadDatabase(source, filepath.Join(tmpDir, "ip2region_v4.xdb"), xdb.IPv4, app.ipv4DB); err != nil {
+		t.Fatalf("expected embedded fallback, got %v", err)
+	}
+	if got := app.lookupRegion("114.114.114.114"); got != "中国|0|江苏省|南京市|电信" {
+		t.Errorf("lookupRegion from the embedded snapshot = %q", got)
+	}
+	checkFallbackWarning(t, logs)
+
+	// Without a bundled snapshot the original error is returned.
+	if err := app.loadDatabase(source, filepath.Join(tmpDir, "ip2region_v6.xdb"), xdb.IPv6, app.ipv6DB); err == nil {
+		t.Error("expected an error without an embedded IPv6 snapshot")
+	}
+	if app.ipv6DB.loaded() {
+		t.Error("expected no IPv6 database to be installed")
+	}
+}
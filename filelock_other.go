@@ -0,0 +1,17 @@
+//go:build !unix
+
+package geocn
+
+import "sync"
+
+var fileLocks sync.Map // path -> struct{}
+
+// tryLockFile takes an exclusive in-process lock on path without blocking.
+// Without flock it cannot exclude other processes, only overlapping app
+// instances across config reloads. ok is false when the lock is held.
+func tryLockFile(path string) (unlock func(), ok bool, err error) {
+	if _, held := fileLocks.LoadOrStore(path, struct{}{}); held {
+		return nil, false, nil
+	}
+	return func() { fileLocks.Delete(path) }, true, nil
+}
@@ -1,6 +1,7 @@
 package geocn
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/netip"
@@ -36,6 +37,10 @@ var (
 const (
 	ip2regionIPv4RemoteFile = "https://gh.dev.438250.xyz/https://github.com/lionsoul2014/ip2region/raw/master/data/ip2region_v4.xdb"
 	ip2regionIPv6RemoteFile = "https://gh.dev.438250.xyz/https://github.com/lionsoul2014/ip2region/raw/master/data/ip2region_v6.xdb"
+
+	// Snapshot names looked up under embedded/.
+	embeddedIPv4DB = "ip2region_v4.xdb"
+	embeddedIPv6DB = "ip2region_v6.xdb"
 )
 
 func init() {
@@ -46,40 +51,68 @@ func init() {
 
 // GeoCityApp is the global app module that manages shared ip2region resources.
 type GeoCityApp struct {
-	Interval     caddy.Duration `json:"interval,omitempty"`
-	Timeout      caddy.Duration `json:"timeout,omitempty"`
-	IPv4Source   string         `json:"ipv4_source,omitempty"`
-	IPv6Source   string         `json:"ipv6_source,omitempty"`
-	EnableCache  *bool          `json:"enable_cache,omitempty"`
-	CacheTTL     caddy.Duration `json:"cache_ttl,omitempty"`
-	CacheMaxSize int            `json:"cache_max_size,omitempty"`
+	Interval   caddy.Duration `json:"interval,omitempty"`
+	Timeout    caddy.Duration `json:"timeout,omitempty"`
+	IPv4Source string         `json:"ipv4_source,omitempty"`
+	IPv6Source string         `json:"ipv6_source,omitempty"`
+	CacheConfig
+
+	// PrivateIPs controls how private, loopback, link-local and multicast
+	// addresses resolve: "no_match" (default), "match" (every geocity
+	// matcher accepts them), or a fixed region string.
+	PrivateIPs string `json:"private_ips,omitempty"`
+	// PrivateRanges maps a region string to extra CIDRs treated as internal
+	// and resolved to that region, e.g. office NAT or VPN pools.
+	PrivateRanges map[string][]string `json:"private_ranges,omitempty"`
+	// Overrides maps CIDRs to a region string checked before the database.
+	Overrides map[string]string `json:"overrides,omitempty"`
+	// OverridesSource is an optional file path or URL with more
+	// "<cidr> <value>" lines, refreshed on the database update cycle.
+	OverridesSource string `json:"overrides_source,omitempty"`
+	// NAT64Prefixes lists site-specific NAT64 prefixes whose embedded IPv4
+	// address is looked up instead; 64:ff9b::/96 is always recognized.
+	NAT64Prefixes []string `json:"nat64_prefixes,omitempty"`
+	// LoadMode selects how xdb files are loaded: memory (default, read into
+	// the heap), mmap (mapped read-only) or vector_index (only the index in
+	// memory, segments read from the file per lookup).
+	LoadMode string `json:"load_mode,omitempty"`
 
 	ctx           caddy.Context
-	lock          *sync.RWMutex
-	searcherIPv4  *xdb.Searcher
-	searcherIPv6  *xdb.Searcher
+	ipv4DB        *dbHolder[*xdbSearcher]
+	ipv6DB        *dbHolder[*xdbSearcher]
+	cancel        context.CancelFunc // stops background work; set in Start
+	wg            *sync.WaitGroup    // tracks background goroutines
 	localIPv4File string
 	localIPv6File string
 	logger        *zap.Logger
 	cache         *cityCache
+	cacheKey      string
+	private       *privatePolicy
+	overrides     *overrides
+	normalizer    *addrNormalizer
 	httpClient    *http.Client
+
+	// ipv4Stamp and ipv6Stamp are the local file versions reloadIfChanged
+	// last saw.
+	ipv4Stamp, ipv6Stamp fileStamp
 }
 
 // GeoCity is a lightweight matcher that references the global GeoCityApp.
 type GeoCity struct {
 	Regions []string `json:"regions,omitempty"`
+	ipSource
 
 	app         *GeoCityApp
 	logger      *zap.Logger
 	allKeywords []string
 }
 
-// cityCache is a TTL cache for IP region lookups.
-type cityCache = Cache[string]
+// cityCache is a TTL cache for region lookups, keyed by xdb segment network.
+type cityCache = prefixCache[string]
 
 // newCityCache creates a new city cache.
-func newCityCache(maxSize int, ttl time.Duration) *cityCache {
-	return NewCache[string](maxSize, ttl)
+func newCityCache(maxSize int, ttl time.Duration, opts ...CacheOption) *cityCache {
+	return newPrefixCache[string](maxSize, ttl, opts...)
 }
 
 func (GeoCityApp) CaddyModule() caddy.ModuleInfo {
@@ -98,7 +131,9 @@ func (GeoCity) CaddyModule() caddy.ModuleInfo {
 
 func (app *GeoCityApp) Provision(ctx caddy.Context) error {
 	app.ctx = ctx
-	app.lock = new(sync.RWMutex)
+	app.ipv4DB = new(dbHolder[*xdbSearcher])
+	app.ipv6DB = new(dbHolder[*xdbSearcher])
+	app.wg = new(sync.WaitGroup)
 	app.logger = ctx.Logger()
 
 	if app.Timeout == 0 {
@@ -123,15 +158,45 @@ func (app *GeoCityApp) Provision(ctx caddy.Context) error {
 	}
 
 	if *app.EnableCache {
-		if app.CacheMaxSize <= 0 {
+		if err := app.CacheConfig.validate(); err != nil {
+			return fmt.Errorf("geocity: %w", err)
+		}
+		if app.CacheMaxSize <= 0 && app.CacheMaxMemory == 0 {
 			app.CacheMaxSize = 10000
 		}
 		if app.CacheTTL == 0 {
 			app.CacheTTL = caddy.Duration(5 * time.Minute)
 		}
+		if app.CacheNegativeTTL == 0 {
+			app.CacheNegativeTTL = caddy.Duration(time.Minute)
+		}
 		app.logger.Info("City cache enabled",
 			zap.Duration("ttl", time.Duration(app.CacheTTL)),
-			zap.Int("max_size", app.CacheMaxSize))
+			zap.Duration("negative_ttl", time.Duration(app.CacheNegativeTTL)),
+			zap.Int("max_size", app.CacheMaxSize),
+			zap.Int64("max_memory", app.CacheMaxMemory),
+			zap.String("policy", app.CachePolicy),
+			zap.Int("shards", max(app.CacheShards, 1)))
+	}
+
+	private, err := newPrivatePolicy(app.PrivateIPs, app.PrivateRanges, validRegion)
+	if err != nil {
+		return fmt.Errorf("geocity: %w", err)
+	}
+	app.private = private
+
+	app.overrides, err = newOverrides(app.Overrides, app.OverridesSource, validRegion)
+	if err != nil {
+		return fmt.Errorf("geocity: %w", err)
+	}
+
+	app.normalizer, err = newAddrNormalizer(app.NAT64Prefixes)
+	if err != nil {
+		return fmt.Errorf("geocity: %w", err)
+	}
+
+	if err := checkLoadMode(app.LoadMode, loadMemory, loadMmap, loadVectorIndex); err != nil {
+		return fmt.Errorf("geocity: %w", err)
 	}
 
 	return nil
@@ -152,10 +217,21 @@ func (app *GeoCityApp) Validate() error {
 			return fmt.Errorf("geocity: ipv6_source file not found: %s", app.IPv6Source)
 		}
 	}
+	if app.OverridesSource != "" && !isHTTPSource(app.OverridesSource) {
+		if _, err := os.Stat(app.OverridesSource); err != nil {
+			return fmt.Errorf("geocity: overrides file not found: %s", app.OverridesSource)
+		}
+	}
 	return nil
 }
 
 func (app *GeoCityApp) Start() error {
+	// Background work runs under a child of the config context so that Stop
+	// can cancel it (including in-flight downloads) and wait for it.
+	var ctx context.Context
+	ctx, app.cancel = context.WithCancel(app.ctx.Context)
+	app.ctx.Context = ctx
+
 	// Create cache directory in Start() to avoid side effects during caddy validate
 	caddyDir := caddy.AppDataDir()
 	cacheDir := filepath.Join(caddyDir, "geocity")
@@ -165,73 +241,87 @@ func (app *GeoCityApp) Start() error {
 	app.localIPv4File = filepath.Join(cacheDir, "ipv4.xdb")
 	app.localIPv6File = filepath.Join(cacheDir, "ipv6.xdb")
 
-	if app.EnableCache != nil && *app.EnableCache {
-		app.cache = newCityCache(app.CacheMaxSize, time.Duration(app.CacheTTL))
-	}
-
-	if err := app.loadDatabase(app.IPv4Source, app.localIPv4File, xdb.IPv4, &app.searcherIPv4); err != nil {
+	if err := app.loadDatabase(app.IPv4Source, app.localIPv4File, xdb.IPv4, app.ipv4DB); err != nil {
 		app.logger.Warn("failed to load IPv4 database",
 			zap.String("source", app.IPv4Source),
 			zap.Error(err))
 	}
 
-	if err := app.loadDatabase(app.IPv6Source, app.localIPv6File, xdb.IPv6, &app.searcherIPv6); err != nil {
+	if err := app.loadDatabase(app.IPv6Source, app.localIPv6File, xdb.IPv6, app.ipv6DB); err != nil {
 		app.logger.Warn("failed to load IPv6 database",
 			zap.String("source", app.IPv6Source),
 			zap.Error(err))
 	}
 
-	if app.searcherIPv4 == nil && app.searcherIPv6 == nil {
+	if !app.ipv4DB.loaded() && !app.ipv6DB.loaded() {
 		return fmt.Errorf("failed to load any IP database (neither IPv4 nor IPv6)")
 	}
+	app.loadOverrides(filepath.Join(cacheDir, "overrides.txt"))
 
 	// Only start background goroutines after all error checks pass
-	if app.cache != nil {
-		go app.cache.Cleanup(app.ctx)
+	if err := app.startCache(cacheDir); err != nil {
+		return err
 	}
-	go app.periodicUpdate()
+	app.wg.Go(app.periodicUpdate)
 	return nil
 }
 
-func (app *GeoCityApp) Stop() error {
+// startCache attaches the lookup cache, reusing the one from the previous
+// config when the cache settings, sources and databases are unchanged.
+func (app *GeoCityApp) startCache(cacheDir string) error {
+	if app.EnableCache == nil || !*app.EnableCache {
+		return nil
+	}
+	var snapshot string
+	if app.CachePersist {
+		snapshot = filepath.Join(cacheDir, "cache.gob")
+	}
+	key := cachePoolKey("geocity", app.CacheConfig,
+		app.IPv4Source, app.ipv4DB.contentKey(), app.IPv6Source, app.ipv6DB.contentKey())
+	cache, err := acquireCache(key, snapshot, app.logger, func() *cityCache {
+		return newCityCache(app.CacheMaxSize, time.Duration(app.CacheTTL), app.CacheConfig.options()...)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create cache: %w", err)
+	}
+	app.cache, app.cacheKey = cache, key
+
+	if err := registerCacheMetrics(app.ctx.GetMetricsRegistry(), "geocity", app.cache); err != nil {
+		app.logger.Warn("failed to register cache metrics", zap.Error(err))
+	}
 	return nil
 }
 
-func (app *GeoCityApp) Cleanup() error {
-	app.lock.Lock()
-	defer app.lock.Unlock()
-
-	if app.searcherIPv4 != nil {
-		app.searcherIPv4.Close()
-		app.searcherIPv4 = nil
+// Stop cancels the background updater and waits for it to return, so a
+// reload never has two updaters of the same config running at once.
+func (app *GeoCityApp) Stop() error {
+	if app.cancel != nil {
+		app.cancel()
 	}
-	if app.searcherIPv6 != nil {
-		app.searcherIPv6.Close()
-		app.searcherIPv6 = nil
+	if app.wg != nil {
+		app.wg.Wait()
 	}
-	return nil
+	err := releaseCache(app.cacheKey)
+	app.cacheKey = ""
+	return err
 }
 
-// openXDBFromFile loads an xdb file entirely into memory and returns a Searcher.
-// This avoids holding file handles open, which prevents os.Rename failures on Windows.
-func openXDBFromFile(version *xdb.Version, path string) (*xdb.Searcher, error) {
-	data, err := xdb.LoadContentFromFile(path)
-	if err != nil {
-		return nil, err
+func (app *GeoCityApp) Cleanup() error {
+	if err := releaseCache(app.cacheKey); err != nil {
+		app.logger.Warn("failed to release cache", zap.Error(err))
 	}
-	return xdb.NewWithBuffer(version, data)
+	app.cacheKey = ""
+
+	app.ipv4DB.close()
+	app.ipv6DB.close()
+	return nil
 }
 
-func (app *GeoCityApp) loadDatabase(source, cacheFile string, version *xdb.Version, searcher **xdb.Searcher) error {
-	if s, err := openXDBFromFile(version, cacheFile); err == nil {
-		app.lock.Lock()
-		oldSearcher := *searcher
-		*searcher = s
-		app.lock.Unlock()
-		if oldSearcher != nil {
-			oldSearcher.Close()
-		}
+func (app *GeoCityApp) loadDatabase(source, cacheFile string, version *xdb.Version, db *dbHolder[*xdbSearcher]) error {
+	if s, loaded, err := acquireXDB(app.LoadMode, version, source, cacheFile); err == nil {
+		app.swapSearcher(db, s)
 		app.logger.Debug("loaded database from cache",
+			zap.Bool("reused", loaded),
 			zap.String("cache", cacheFile),
 			zap.String("source", source))
 		return nil
@@ -241,11 +331,11 @@ func (app *GeoCityApp) loadDatabase(source, cacheFile string, version *xdb.Versi
 		ctx, cancel := getContextWithTimeout(app.ctx, app.Timeout)
 		defer cancel()
 		if err := downloadFile(ctx, app.httpClient, source, cacheFile); err != nil {
-			return fmt.Errorf("download from %s: %w", source, err)
+			return app.loadEmbedded(source, version, db, fmt.Errorf("download from %s: %w", source, err))
 		}
 	} else {
 		if _, err := os.Stat(source); err != nil {
-			return fmt.Errorf("local file not found: %w", err)
+			return app.loadEmbedded(source, version, db, fmt.Errorf("local file not found: %w", err))
 		}
 		if err := copyFile(source, cacheFile); err != nil {
 			app.logger.Debug("failed to copy database to cache, using source directly",
@@ -261,17 +351,11 @@ func (app *GeoCityApp) loadDatabase(source, cacheFile string, version *xdb.Versi
 		}
 	}
 
-	s, err := openXDBFromFile(version, cacheFile)
+	s, _, err := acquireXDB(app.LoadMode, version, source, cacheFile)
 	if err != nil {
-		return fmt.Errorf("load database: %w", err)
-	}
-	app.lock.Lock()
-	oldSearcher := *searcher
-	*searcher = s
-	app.lock.Unlock()
-	if oldSearcher != nil {
-		oldSearcher.Close()
+		return app.loadEmbedded(source, version, db, fmt.Errorf("load database: %w", err))
 	}
+	app.swapSearcher(db, s)
 
 	app.logger.Info("loaded database",
 		zap.String("source", source),
@@ -279,11 +363,76 @@ func (app *GeoCityApp) loadDatabase(source, cacheFile string, version *xdb.Versi
 	return nil
 }
 
-func (app *GeoCityApp) updateDatabase(source, localFile string, version *xdb.Version, searcher **xdb.Searcher, label string) error {
+// loadEmbedded falls back to the snapshot compiled in with the geocn_embed
+// build tag. It returns cause unchanged when no snapshot is bundled.
+func (app *GeoCityApp) loadEmbedded(source string, version *xdb.Version, db *dbHolder[*xdbSearcher], cause error) error {
+	name := embeddedIPv6DB
+	if version == xdb.IPv4 {
+		name = embeddedIPv4DB
+	}
+	data, ok := embeddedDatabase(name)
+	if !ok {
+		return cause
+	}
+	header, err := xdb.LoadHeaderFromBuff(data)
+	if err != nil {
+		return fmt.Errorf("%w; embedded database: %v", cause, err)
+	}
+	key := "geocity|embedded|" + name
+	s, _, err := acquireDB(key, func() (*xdbSearcher, func(), error) {
+		s, err := newXDBSearcher(version, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.poolKey = key
+		return s, s.Close, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%w; embedded database: %v", cause, err)
+	}
+	app.swapSearcher(db, s)
+
+	built := time.Unix(int64(header.CreatedAt), 0)
+	app.logger.Warn("source unavailable, using embedded database snapshot",
+		zap.String("source", source),
+		zap.Time("built", built),
+		zap.Duration("age", time.Since(built).Round(time.Hour)),
+		zap.NamedError("cause", cause))
+	return nil
+}
+
+// swapSearcher installs s into db. The searcher it replaces is released
+// once in-flight lookups finish, and results cached from it are purged if
+// the database content changed. Only entries of db's address family are
+// purged; the other database still backs the rest.
+func (app *GeoCityApp) swapSearcher(db *dbHolder[*xdbSearcher], s *xdbSearcher) {
+	is4 := db == app.ipv4DB
+	db.swap(s, s.poolKey, s.release, func() { app.purgeFamily(is4) })
+}
+
+// purgeFamily drops cached IPv4 results if is4, IPv6 results otherwise.
+func (app *GeoCityApp) purgeFamily(is4 bool) {
+	if app.cache != nil {
+		app.cache.PurgeFamily(is4)
+	}
+}
+
+func (app *GeoCityApp) updateDatabase(source, localFile string, version *xdb.Version, db *dbHolder[*xdbSearcher], label string) error {
 	if !isHTTPSource(source) {
-		return app.loadDatabase(source, localFile, version, searcher)
+		return app.loadDatabase(source, localFile, version, db)
 	}
 
+	unlock, ok, err := tryLockFile(localFile)
+	if err != nil {
+		return fmt.Errorf("lock %s database file: %w", label, err)
+	}
+	if !ok {
+		app.logger.Debug(label+" database update already in progress elsewhere, skipping",
+			zap.String("file", localFile))
+		return nil
+	}
+	defer unlock()
+
 	tempFile := localFile + ".temp"
 	// Remove stale temp file from a previous failed update to avoid downloadFile skipping
 	os.Remove(tempFile)
@@ -298,8 +447,9 @@ func (app *GeoCityApp) updateDatabase(source, localFile string, version *xdb.Ver
 		return fmt.Errorf("download %s database failed: %w", label, err)
 	}
 
-	// Validate by loading into memory — no file handle held after this
-	tempSearcher, err := openXDBFromFile(version, tempFile)
+	// Validate by opening in the configured load mode; memory mode holds no
+	// file handle after this, mmap and vector_index survive the rename below
+	tempSearcher, err := openXDB(app.LoadMode, version, tempFile)
 	if err != nil {
 		if rmErr := os.Remove(tempFile); rmErr != nil {
 			app.logger.Debug("failed to remove temp file", zap.String("file", tempFile), zap.Error(rmErr))
@@ -315,26 +465,33 @@ func (app *GeoCityApp) updateDatabase(source, localFile string, version *xdb.Ver
 		return fmt.Errorf("replace %s database file failed: %w", label, err)
 	}
 
-	// Swap the already-loaded searcher directly — no need to re-open from file
-	app.lock.Lock()
-	oldSearcher := *searcher
-	*searcher = tempSearcher
-	app.lock.Unlock()
-
-	if oldSearcher != nil {
-		oldSearcher.Close()
+	// Swap the already-loaded searcher directly — no need to re-open from file.
+	// If another config already pooled identical content, share that instead.
+	key, err := fileDBKey("geocity|"+version.Name+"|"+app.LoadMode, source, localFile)
+	if err == nil {
+		var s *xdbSearcher
+		var loaded bool
+		s, loaded, err = acquireDB(key, func() (*xdbSearcher, func(), error) {
+			tempSearcher.poolKey = key
+			return tempSearcher, tempSearcher.Close, nil
+		})
+		if err == nil && loaded {
+			tempSearcher.Close()
+			tempSearcher = s
+		}
 	}
+	app.swapSearcher(db, tempSearcher)
 
 	app.logger.Info(label+" database updated successfully", zap.String("file", localFile))
 	return nil
 }
 
 func (app *GeoCityApp) updateDatabaseIPv4() error {
-	return app.updateDatabase(app.IPv4Source, app.localIPv4File, xdb.IPv4, &app.searcherIPv4, "IPv4")
+	return app.updateDatabase(app.IPv4Source, app.localIPv4File, xdb.IPv4, app.ipv4DB, "IPv4")
 }
 
 func (app *GeoCityApp) updateDatabaseIPv6() error {
-	return app.updateDatabase(app.IPv6Source, app.localIPv6File, xdb.IPv6, &app.searcherIPv6, "IPv6")
+	return app.updateDatabase(app.IPv6Source, app.localIPv6File, xdb.IPv6, app.ipv6DB, "IPv6")
 }
 
 func (app *GeoCityApp) periodicUpdate() {
@@ -346,12 +503,61 @@ func (app *GeoCityApp) periodicUpdate() {
 		case <-ticker.C:
 			app.tryUpdateSource(app.IPv4Source, app.localIPv4File, app.updateDatabaseIPv4, "IPv4")
 			app.tryUpdateSource(app.IPv6Source, app.localIPv6File, app.updateDatabaseIPv6, "IPv6")
+			app.reloadIfChanged(app.IPv4Source, app.localIPv4File, &app.ipv4Stamp, xdb.IPv4, app.ipv4DB)
+			app.reloadIfChanged(app.IPv6Source, app.localIPv6File, &app.ipv6Stamp, xdb.IPv6, app.ipv6DB)
+			app.updateOverrides()
 		case <-app.ctx.Done():
 			return
 		}
 	}
 }
 
+// reloadIfChanged loads localFile when another instance sharing the data
+// directory (whose update this one skipped) has replaced it. The file is
+// only hashed when its stamp has changed.
+func (app *GeoCityApp) reloadIfChanged(source, localFile string, stamp *fileStamp, version *xdb.Version, db *dbHolder[*xdbSearcher]) {
+	if !isHTTPSource(source) || !stamp.changed(localFile) {
+		return
+	}
+	var current string
+	if snap := db.acquire(); snap != nil {
+		current = snap.key
+		snap.done()
+	}
+	key, err := fileDBKey("geocity|"+version.Name+"|"+app.LoadMode, source, localFile)
+	if err != nil || key == current {
+		return
+	}
+	s, _, err := acquireXDB(app.LoadMode, version, source, localFile)
+	if err != nil {
+		app.logger.Warn("failed to reload updated database", zap.String("file", localFile), zap.Error(err))
+		return
+	}
+	app.swapSearcher(db, s)
+	app.logger.Info("reloaded database updated by another instance", zap.String("file", localFile))
+}
+
+// loadOverrides reads the overrides source, keeping only the inline entries
+// if it is unavailable.
+func (app *GeoCityApp) loadOverrides(localFile string) {
+	app.overrides.localFile = localFile
+	ctx, cancel := getContextWithTimeout(app.ctx, app.Timeout)
+	defer cancel()
+	if err := app.overrides.load(ctx, app.httpClient); err != nil {
+		app.logger.Warn("failed to load overrides",
+			zap.String("source", app.OverridesSource),
+			zap.Error(err))
+	}
+}
+
+func (app *GeoCityApp) updateOverrides() {
+	ctx, cancel := getContextWithTimeout(app.ctx, app.Timeout)
+	defer cancel()
+	if err := app.overrides.update(ctx, app.httpClient, time.Duration(app.Interval)); err != nil {
+		app.logger.Warn("update overrides failed", zap.Error(err))
+	}
+}
+
 func (app *GeoCityApp) tryUpdateSource(source, localFile string, updateFn func() error, label string) {
 	if source == "" || !isHTTPSource(source) {
 		return
@@ -373,41 +579,70 @@ func (app *GeoCityApp) tryUpdateSource(source, localFile string, updateFn func()
 }
 
 func (app *GeoCityApp) lookupRegion(host string) string {
-	nip, err := netip.ParseAddr(host)
-	if err != nil || !nip.IsValid() || checkPrivateAddr(nip) {
+	nip, ok := app.normalizer.normalize(host)
+	if !ok {
 		return ""
 	}
+	if region, ok := app.overrides.lookup(nip); ok {
+		return region
+	}
+	if region, ok := app.private.resolve(nip, ""); ok {
+		return region
+	}
 
 	if app.cache != nil {
-		if region, found := app.cache.Get(host); found {
+		if region, found := app.cache.Get(nip); found {
 			return region
 		}
 	}
 
-	app.lock.RLock()
-	searcher := app.searcherIPv6
-	if nip.Is4() || nip.Is4In6() {
-		searcher = app.searcherIPv4
+	db := app.ipv6DB
+	if nip.Is4() {
+		db = app.ipv4DB
 	}
-	if searcher == nil {
-		app.lock.RUnlock()
+	snap := db.acquire()
+	if snap == nil {
 		return ""
 	}
-	region, err := searcher.SearchByStr(host)
-	app.lock.RUnlock()
+	// Pinned until the result is cached; see GeoCNApp.lookupCountry.
+	defer snap.done()
+	return app.searchSnapshot(snap, nip)
+}
+
+// searchSnapshot searches nip in the pinned snapshot and caches the result.
+func (app *GeoCityApp) searchSnapshot(snap *dbSnapshot[*xdbSearcher], nip netip.Addr) string {
+	region, network, err := snap.db.search(nip)
 
 	if err != nil {
-		app.logger.Debug("failed to search IP location", zap.String("ip", host), zap.Error(err))
-		return ""
+		app.logger.Debug("failed to search IP location", zap.String("ip", nip.String()), zap.Error(err))
+		region, network = "", hostPrefix(nip)
 	}
 
-	if app.cache != nil && region != "" {
-		app.cache.Set(host, region)
+	// Misses are cached too (under negative_ttl), so repeated traffic from
+	// ranges the database does not know stays off the searcher.
+	if app.cache != nil {
+		if region != "" {
+			app.cache.Set(network, region)
+		} else {
+			app.cache.SetWithTTL(network, "", time.Duration(app.CacheNegativeTTL))
+		}
 	}
 
 	return region
 }
 
+// matchesPrivate reports whether host is internal and private_ips is "match".
+func (app *GeoCityApp) matchesPrivate(host string) bool {
+	nip, ok := app.normalizer.normalize(host)
+	return ok && app.private.matchesAll(nip)
+}
+
+// internalHop reports whether host is an internal proxy hop that chain
+// matching skips.
+func (app *GeoCityApp) internalHop(host string) bool {
+	return internalHop(app.normalizer, app.overrides, app.private, host)
+}
+
 // --- GeoCity matcher ---
 
 func (g *GeoCity) Provision(ctx caddy.Context) error {
@@ -433,13 +668,19 @@ func (g *GeoCity) Validate() error {
 	if len(g.allKeywords) == 0 {
 		return fmt.Errorf("geocity matcher: at least one region, province, or city keyword must be specified")
 	}
+	if err := g.ipSource.validate(); err != nil {
+		return fmt.Errorf("geocity matcher: %w", err)
+	}
 	return nil
 }
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
 //
 //	geocity {
-//	    regions       <keyword> [<keyword>...]
+//	    regions         <keyword> [<keyword>...]
+//	    source          <placeholder>
+//	    source_fallback client_ip|no_match
+//	    chain           any|all|first|last
 //	}
 func (g *GeoCity) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
@@ -452,7 +693,13 @@ func (g *GeoCity) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 				g.Regions = append(g.Regions, args...)
 			default:
-				return d.ArgErr()
+				ok, err := g.ipSource.unmarshalCaddyfile(d)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return d.ArgErr()
+				}
 			}
 		}
 	}
@@ -460,14 +707,18 @@ func (g *GeoCity) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 }
 
 // matchRegion checks if the region string matches any of the configured keywords.
-// A keyword containing "+" requires all parts to be present (AND logic).
-// Multiple keywords are OR'd together.
 func (g *GeoCity) matchRegion(region string) bool {
 	if len(g.allKeywords) == 0 {
 		return true
 	}
+	return matchRegionKeywords(g.allKeywords, region)
+}
 
-	for _, kw := range g.allKeywords {
+// matchRegionKeywords reports whether region matches any of keywords.
+// A keyword containing "+" requires all parts to be present (AND logic).
+// Multiple keywords are OR'd together.
+func matchRegionKeywords(keywords []string, region string) bool {
+	for _, kw := range keywords {
 		if strings.Contains(kw, "+") {
 			parts := strings.Split(kw, "+")
 			allMatch := true
@@ -488,6 +739,45 @@ func (g *GeoCity) matchRegion(region string) bool {
 	return false
 }
 
+// regionInfo holds the fields of a geocity region string.
+type regionInfo struct {
+	Country  string
+	Province string
+	City     string
+	ISP      string
+}
+
+// parseRegion splits an ip2region region string. The standard layout is
+// "国家|区域|省份|城市|ISP"; the four-field "国家|省份|城市|ISP" layout is
+// accepted too. "0" marks an unknown field and is returned as empty.
+func parseRegion(region string) regionInfo {
+	if region == "" {
+		return regionInfo{}
+	}
+	fields := strings.Split(region, "|")
+	if len(fields) == 5 {
+		fields = append(fields[:1], fields[2:]...)
+	}
+	get := func(i int) string {
+		if i >= len(fields) || fields[i] == "0" {
+			return ""
+		}
+		return strings.TrimSpace(fields[i])
+	}
+	return regionInfo{Country: get(0), Province: get(1), City: get(2), ISP: get(3)}
+}
+
+// matches reports whether a client at host, whose region lookupRegion
+// returned, satisfies the matcher: a Chinese region matching the keywords,
+// or an internal address when private_ips is "match".
+func (g *GeoCity) matches(host, region string) bool {
+	if region == "" {
+		return g.app.matchesPrivate(host)
+	}
+	country, _, _ := strings.Cut(region, "|")
+	return strings.TrimSpace(country) == "中国" && g.matchRegion(region)
+}
+
 func (g *GeoCity) MatchWithError(r *http.Request) (bool, error) {
 	return g.Match(r), nil
 }
@@ -498,14 +788,25 @@ func (g *GeoCity) Match(r *http.Request) bool {
 		return false
 	}
 
-	host, raw := extractClientIP(r)
+	if g.Chain != "" {
+		hops := forwardedChain(r, g.app.internalHop)
+		matched := matchChain(g.Chain, hops, func(host string) bool {
+			return g.matches(host, g.app.lookupRegion(host))
+		})
+		g.logger.Debug("geocity chain match result",
+			zap.Strings("hops", hops),
+			zap.String("chain", g.Chain),
+			zap.Bool("matched", matched))
+		return matched
+	}
+
+	host, raw, client := g.resolve(r)
 	if host == "" {
 		return false
 	}
 
-	region := g.app.lookupRegion(host)
-	country, _, _ := strings.Cut(region, "|")
-	matched := region != "" && strings.TrimSpace(country) == "中国" && g.matchRegion(region)
+	region := lookupSource(r, client, regionVarKey, host, g.app.lookupRegion)
+	matched := g.matches(host, region)
 
 	g.logger.Debug("geocity match result",
 		zap.String("client_ip", raw),
@@ -523,8 +824,15 @@ func (g *GeoCity) Match(r *http.Request) bool {
 //	        timeout 30s
 //	        ipv4_source <url_or_path>
 //	        ipv6_source <url_or_path>
-//	        cache ttl 5m size 10000
+//	        cache ttl 5m negative_ttl 1m size 10000 max_memory 64MiB policy random|lru|tinylfu shards 1 [persist]
 //	        # or: cache off
+//	        private_ips no_match|match|<region>
+//	        private_range <region> <cidr> [<cidr>...]
+//	        nat64_prefixes <prefix> [<prefix>...]
+//	        load_mode memory|mmap|vector_index
+//	        overrides [<file_or_url>] {
+//	            <cidr> <region>
+//	        }
 //	    }
 //	}
 func parseGeoCityAppCaddyfile(d *caddyfile.Dispenser, _ any) (any, error) {
@@ -562,12 +870,39 @@ func parseGeoCityAppCaddyfile(d *caddyfile.Dispenser, _ any) (any, error) {
 				}
 				app.IPv6Source = d.Val()
 			case "cache":
-				if err := parseCacheBlock(d, &app.EnableCache, &app.CacheTTL, &app.CacheMaxSize); err != nil {
+				if err := parseCacheBlock(d, &app.CacheConfig); err != nil {
 					return nil, err
 				}
 				if app.EnableCache != nil && !*app.EnableCache {
 					continue
 				}
+			case "private_ips":
+				if !d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				app.PrivateIPs = d.Val()
+			case "private_range":
+				if err := parsePrivateRange(d, &app.PrivateRanges); err != nil {
+					return nil, err
+				}
+			case "overrides":
+				if err := parseOverridesBlock(d, &app.OverridesSource, &app.Overrides); err != nil {
+					return nil, err
+				}
+			case "load_mode":
+				if !d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				app.LoadMode = d.Val()
+				if d.NextArg() {
+					return nil, d.ArgErr()
+				}
+			case "nat64_prefixes":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return nil, d.ArgErr()
+				}
+				app.NAT64Prefixes = append(app.NAT64Prefixes, args...)
 			default:
 				return nil, d.ArgErr()
 			}
@@ -1,6 +1,7 @@
 package geocn
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/netip"
@@ -22,6 +23,7 @@ var (
 	_ caddy.Module                      = (*GeoCN)(nil)
 	_ caddyhttp.RequestMatcherWithError = (*GeoCN)(nil)
 	_ caddy.Provisioner                 = (*GeoCN)(nil)
+	_ caddy.Validator                   = (*GeoCN)(nil)
 	_ caddyfile.Unmarshaler             = (*GeoCN)(nil)
 
 	_ caddy.Module       = (*GeoCNApp)(nil)
@@ -31,7 +33,17 @@ var (
 	_ caddy.CleanerUpper = (*GeoCNApp)(nil)
 )
 
-const remotefile = "https://gh.dev.438250.xyz/https://github.com/Hackl0us/GeoIP2-CN/raw/release/Country.mmdb"
+const (
+	remotefile = "https://gh.dev.438250.xyz/https://github.com/Hackl0us/GeoIP2-CN/raw/release/Country.mmdb"
+
+	// embeddedCountryDB is the snapshot name looked up under embedded/.
+	embeddedCountryDB = "Country.mmdb"
+)
+
+// embeddedDatabase returns the snapshot with the given file name bundled
+// under embedded/. It is a variable so tests can supply snapshots without
+// the geocn_embed build tag.
+var embeddedDatabase = bundledDatabase
 
 func init() {
 	caddy.RegisterModule(GeoCNApp{})
@@ -41,34 +53,60 @@ func init() {
 
 // GeoCNApp is the global app module that manages shared GeoIP resources.
 type GeoCNApp struct {
-	Interval     caddy.Duration `json:"interval,omitempty"`
-	Timeout      caddy.Duration `json:"timeout,omitempty"`
-	Source       string         `json:"source,omitempty"`
-	EnableCache  *bool          `json:"enable_cache,omitempty"`
-	CacheTTL     caddy.Duration `json:"cache_ttl,omitempty"`
-	CacheMaxSize int            `json:"cache_max_size,omitempty"`
+	Interval caddy.Duration `json:"interval,omitempty"`
+	Timeout  caddy.Duration `json:"timeout,omitempty"`
+	Source   string         `json:"source,omitempty"`
+	CacheConfig
+
+	// PrivateIPs controls how private, loopback, link-local and multicast
+	// addresses resolve: "no_match" (default), "match" (treated as CN),
+	// or a fixed country code.
+	PrivateIPs string `json:"private_ips,omitempty"`
+	// PrivateRanges maps a country code to extra CIDRs treated as internal
+	// and resolved to that country, e.g. office NAT or VPN pools.
+	PrivateRanges map[string][]string `json:"private_ranges,omitempty"`
+	// Overrides maps CIDRs to a country code checked before the database.
+	Overrides map[string]string `json:"overrides,omitempty"`
+	// OverridesSource is an optional file path or URL with more
+	// "<cidr> <value>" lines, refreshed on the database update cycle.
+	OverridesSource string `json:"overrides_source,omitempty"`
+	// NAT64Prefixes lists site-specific NAT64 prefixes whose embedded IPv4
+	// address is looked up instead; 64:ff9b::/96 is always recognized.
+	NAT64Prefixes []string `json:"nat64_prefixes,omitempty"`
+	// LoadMode selects how database files are loaded: memory (default,
+	// read into the heap) or mmap (mapped read-only).
+	LoadMode string `json:"load_mode,omitempty"`
 
 	ctx        caddy.Context
-	lock       *sync.RWMutex
-	dbReader   *geoip2.Reader
+	db         *dbHolder[*geoip2.Reader]
+	cancel     context.CancelFunc // stops background work; set in Start
+	wg         *sync.WaitGroup    // tracks background goroutines
 	logger     *zap.Logger
 	cache      *ipCache
+	cacheKey   string
+	private    *privatePolicy
+	overrides  *overrides
+	normalizer *addrNormalizer
 	localFile  string
+	// localStamp is the localFile version reloadIfChanged last saw.
+	localStamp fileStamp
 	httpClient *http.Client
 }
 
 // GeoCN is a lightweight matcher that references the global GeoCNApp.
 type GeoCN struct {
+	ipSource
+
 	app    *GeoCNApp
 	logger *zap.Logger
 }
 
-// ipCache is a TTL cache for IP country lookups.
-type ipCache = Cache[string]
+// ipCache is a TTL cache for country lookups, keyed by mmdb network.
+type ipCache = prefixCache[string]
 
 // newIPCache creates a new IP cache.
-func newIPCache(maxSize int, ttl time.Duration) *ipCache {
-	return NewCache[string](maxSize, ttl)
+func newIPCache(maxSize int, ttl time.Duration, opts ...CacheOption) *ipCache {
+	return newPrefixCache[string](maxSize, ttl, opts...)
 }
 
 func (GeoCNApp) CaddyModule() caddy.ModuleInfo {
@@ -86,6 +124,12 @@ func (GeoCN) CaddyModule() caddy.ModuleInfo {
 }
 
 func (app *GeoCNApp) Start() error {
+	// Background work runs under a child of the config context so that Stop
+	// can cancel it (including in-flight downloads) and wait for it.
+	var ctx context.Context
+	ctx, app.cancel = context.WithCancel(app.ctx.Context)
+	app.ctx.Context = ctx
+
 	// Create cache directory in Start() to avoid side effects during caddy validate
 	caddyDir := caddy.AppDataDir()
 	cacheDir := filepath.Join(caddyDir, "geocn")
@@ -94,29 +138,62 @@ func (app *GeoCNApp) Start() error {
 	}
 	app.localFile = filepath.Join(cacheDir, "Country.mmdb")
 
-	if app.EnableCache != nil && *app.EnableCache {
-		app.cache = newIPCache(app.CacheMaxSize, time.Duration(app.CacheTTL))
-	}
-
 	if err := app.loadDatabase(); err != nil {
 		return fmt.Errorf("failed to load GeoIP database: %w", err)
 	}
+	app.loadOverrides(filepath.Join(cacheDir, "overrides.txt"))
 
 	// Only start background goroutines after all error checks pass
-	if app.cache != nil {
-		go app.cache.Cleanup(app.ctx)
+	if err := app.startCache(cacheDir); err != nil {
+		return err
 	}
-	go app.periodicUpdate()
+	app.wg.Go(app.periodicUpdate)
 	return nil
 }
 
-func (app *GeoCNApp) Stop() error {
+// startCache attaches the lookup cache, reusing the one from the previous
+// config when the cache settings, source and database are unchanged.
+func (app *GeoCNApp) startCache(cacheDir string) error {
+	if app.EnableCache == nil || !*app.EnableCache {
+		return nil
+	}
+	var snapshot string
+	if app.CachePersist {
+		snapshot = filepath.Join(cacheDir, "cache.gob")
+	}
+	key := cachePoolKey("geocn", app.CacheConfig, app.Source, app.db.contentKey())
+	cache, err := acquireCache(key, snapshot, app.logger, func() *ipCache {
+		return newIPCache(app.CacheMaxSize, time.Duration(app.CacheTTL), app.CacheConfig.options()...)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create cache: %w", err)
+	}
+	app.cache, app.cacheKey = cache, key
+
+	if err := registerCacheMetrics(app.ctx.GetMetricsRegistry(), "geocn", app.cache); err != nil {
+		app.logger.Warn("failed to register cache metrics", zap.Error(err))
+	}
 	return nil
 }
 
+// Stop cancels the background updater and waits for it to return, so a
+// reload never has two updaters of the same config running at once.
+func (app *GeoCNApp) Stop() error {
+	if app.cancel != nil {
+		app.cancel()
+	}
+	if app.wg != nil {
+		app.wg.Wait()
+	}
+	err := releaseCache(app.cacheKey)
+	app.cacheKey = ""
+	return err
+}
+
 func (app *GeoCNApp) Provision(ctx caddy.Context) error {
 	app.ctx = ctx
-	app.lock = new(sync.RWMutex)
+	app.db = new(dbHolder[*geoip2.Reader])
+	app.wg = new(sync.WaitGroup)
 	app.logger = ctx.Logger()
 
 	if app.Source == "" {
@@ -134,21 +211,51 @@ func (app *GeoCNApp) Provision(ctx caddy.Context) error {
 	}
 
 	if *app.EnableCache {
-		if app.CacheMaxSize <= 0 {
+		if err := app.CacheConfig.validate(); err != nil {
+			return fmt.Errorf("geocn: %w", err)
+		}
+		if app.CacheMaxSize <= 0 && app.CacheMaxMemory == 0 {
 			app.CacheMaxSize = 10000
 		}
 		if app.CacheTTL == 0 {
 			app.CacheTTL = caddy.Duration(5 * time.Minute)
 		}
+		if app.CacheNegativeTTL == 0 {
+			app.CacheNegativeTTL = caddy.Duration(time.Minute)
+		}
 		app.logger.Info("IP cache enabled",
 			zap.Duration("ttl", time.Duration(app.CacheTTL)),
-			zap.Int("max_size", app.CacheMaxSize))
+			zap.Duration("negative_ttl", time.Duration(app.CacheNegativeTTL)),
+			zap.Int("max_size", app.CacheMaxSize),
+			zap.Int64("max_memory", app.CacheMaxMemory),
+			zap.String("policy", app.CachePolicy),
+			zap.Int("shards", max(app.CacheShards, 1)))
 	}
 
 	if app.Interval == 0 {
 		app.Interval = caddy.Duration(24 * time.Hour)
 	}
 
+	private, err := newPrivatePolicy(app.PrivateIPs, app.PrivateRanges, validCountryCode)
+	if err != nil {
+		return fmt.Errorf("geocn: %w", err)
+	}
+	app.private = private
+
+	app.overrides, err = newOverrides(app.Overrides, app.OverridesSource, validCountryCode)
+	if err != nil {
+		return fmt.Errorf("geocn: %w", err)
+	}
+
+	app.normalizer, err = newAddrNormalizer(app.NAT64Prefixes)
+	if err != nil {
+		return fmt.Errorf("geocn: %w", err)
+	}
+
+	if err := checkLoadMode(app.LoadMode, loadMemory, loadMmap); err != nil {
+		return fmt.Errorf("geocn: %w", err)
+	}
+
 	return nil
 }
 
@@ -162,15 +269,28 @@ func openGeoIPFromFile(path string) (*geoip2.Reader, error) {
 	return geoip2.OpenBytes(data)
 }
 
+// openDatabase installs the database at path, reusing the reader of a
+// previous config when the file content is unchanged.
+func (app *GeoCNApp) openDatabase(path string) error {
+	key, err := fileDBKey("geocn|"+app.LoadMode, app.Source, path)
+	if err != nil {
+		return err
+	}
+	reader, loaded, err := acquireDB(key, func() (*geoip2.Reader, func(), error) {
+		return openGeoIP(app.LoadMode, path)
+	})
+	if err != nil {
+		return err
+	}
+	if loaded {
+		app.logger.Debug("reusing loaded database", zap.String("file", path))
+	}
+	app.swapReader(reader, key, nil)
+	return nil
+}
+
 func (app *GeoCNApp) loadDatabase() error {
-	if reader, err := openGeoIPFromFile(app.localFile); err == nil {
-		app.lock.Lock()
-		oldReader := app.dbReader
-		app.dbReader = reader
-		app.lock.Unlock()
-		if oldReader != nil {
-			oldReader.Close()
-		}
+	if err := app.openDatabase(app.localFile); err == nil {
 		app.logger.Debug("loaded database from cache",
 			zap.String("cache", app.localFile),
 			zap.String("source", app.Source))
@@ -181,11 +301,11 @@ func (app *GeoCNApp) loadDatabase() error {
 		ctx, cancel := getContextWithTimeout(app.ctx, app.Timeout)
 		defer cancel()
 		if err := downloadFile(ctx, app.httpClient, app.Source, app.localFile); err != nil {
-			return fmt.Errorf("download from %s: %w", app.Source, err)
+			return app.loadEmbedded(fmt.Errorf("download from %s: %w", app.Source, err))
 		}
 	} else {
 		if _, err := os.Stat(app.Source); err != nil {
-			return fmt.Errorf("local file not found: %w", err)
+			return app.loadEmbedded(fmt.Errorf("local file not found: %w", err))
 		}
 		if err := copyFile(app.Source, app.localFile); err != nil {
 			app.logger.Debug("failed to copy database to cache, using source directly",
@@ -195,17 +315,8 @@ func (app *GeoCNApp) loadDatabase() error {
 		}
 	}
 
-	reader, err := openGeoIPFromFile(app.localFile)
-	if err != nil {
-		return fmt.Errorf("open database: %w", err)
-	}
-
-	app.lock.Lock()
-	oldReader := app.dbReader
-	app.dbReader = reader
-	app.lock.Unlock()
-	if oldReader != nil {
-		oldReader.Close()
+	if err := app.openDatabase(app.localFile); err != nil {
+		return app.loadEmbedded(fmt.Errorf("open database: %w", err))
 	}
 
 	app.logger.Info("loaded database",
@@ -214,6 +325,68 @@ func (app *GeoCNApp) loadDatabase() error {
 	return nil
 }
 
+// loadEmbedded falls back to the snapshot compiled in with the geocn_embed
+// build tag. It returns cause unchanged when no snapshot is bundled.
+func (app *GeoCNApp) loadEmbedded(cause error) error {
+	data, ok := embeddedDatabase(embeddedCountryDB)
+	if !ok {
+		return cause
+	}
+	key := "geocn|embedded|" + embeddedCountryDB
+	reader, _, err := acquireDB(key, func() (*geoip2.Reader, func(), error) {
+		reader, err := geoip2.OpenBytes(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func() { reader.Close() }, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%w; embedded database: %v", cause, err)
+	}
+	app.swapReader(reader, key, nil)
+
+	built := reader.Metadata().BuildTime()
+	app.logger.Warn("source unavailable, using embedded database snapshot",
+		zap.String("source", app.Source),
+		zap.Time("built", built),
+		zap.Duration("age", time.Since(built).Round(time.Hour)),
+		zap.NamedError("cause", cause))
+	return nil
+}
+
+// swapReader installs reader. Once it is replaced and in-flight lookups
+// finish, a reader pooled under key goes back to dbPool and any other is
+// released with closeReader; results cached from it are purged if the
+// database content changed.
+func (app *GeoCNApp) swapReader(reader *geoip2.Reader, key string, closeReader func()) {
+	release := closeReader
+	if key != "" {
+		release = func() { releaseDB(key) }
+	}
+	app.db.swap(reader, key, release, app.purgeCache)
+}
+
+// purgeCache drops every cached result: unlike geocity's per-family xdb
+// files, the one mmdb answers both address families.
+func (app *GeoCNApp) purgeCache() {
+	if app.cache != nil {
+		app.cache.Purge()
+	}
+}
+
+// loadOverrides reads the overrides source, keeping only the inline entries
+// if it is unavailable.
+func (app *GeoCNApp) loadOverrides(localFile string) {
+	app.overrides.localFile = localFile
+	ctx, cancel := getContextWithTimeout(app.ctx, app.Timeout)
+	defer cancel()
+	if err := app.overrides.load(ctx, app.httpClient); err != nil {
+		app.logger.Warn("failed to load overrides",
+			zap.String("source", app.OverridesSource),
+			zap.Error(err))
+	}
+}
+
 func (app *GeoCNApp) checkNeedUpdate() (bool, error) {
 	if !isHTTPSource(app.Source) {
 		return false, nil
@@ -229,6 +402,17 @@ func (app *GeoCNApp) updateGeoFile() error {
 		return app.loadDatabase()
 	}
 
+	unlock, ok, err := tryLockFile(app.localFile)
+	if err != nil {
+		return fmt.Errorf("lock database file: %w", err)
+	}
+	if !ok {
+		app.logger.Debug("database update already in progress elsewhere, skipping",
+			zap.String("file", app.localFile))
+		return nil
+	}
+	defer unlock()
+
 	tempFile := app.localFile + ".temp"
 	// Remove stale temp file from a previous failed update to avoid downloadFile skipping
 	os.Remove(tempFile)
@@ -243,8 +427,9 @@ func (app *GeoCNApp) updateGeoFile() error {
 		return fmt.Errorf("download failed: %w", err)
 	}
 
-	// Validate by loading into memory — no file handle held after this
-	tempReader, err := openGeoIPFromFile(tempFile)
+	// Validate by opening in the configured load mode; memory mode holds no
+	// file handle after this, mmap and vector_index survive the rename below
+	tempReader, closeTemp, err := openGeoIP(app.LoadMode, tempFile)
 	if err != nil {
 		if rmErr := os.Remove(tempFile); rmErr != nil {
 			app.logger.Debug("failed to remove temp file", zap.String("file", tempFile), zap.Error(rmErr))
@@ -253,22 +438,31 @@ func (app *GeoCNApp) updateGeoFile() error {
 	}
 
 	if err := os.Rename(tempFile, app.localFile); err != nil {
-		tempReader.Close()
+		closeTemp()
 		if rmErr := os.Remove(tempFile); rmErr != nil {
 			app.logger.Debug("failed to remove temp file", zap.String("file", tempFile), zap.Error(rmErr))
 		}
 		return fmt.Errorf("replace database file failed: %w", err)
 	}
 
-	// Swap the already-loaded reader directly — no need to re-open from file
-	app.lock.Lock()
-	oldReader := app.dbReader
-	app.dbReader = tempReader
-	app.lock.Unlock()
-
-	if oldReader != nil {
-		oldReader.Close()
+	// Swap the already-loaded reader directly — no need to re-open from file.
+	// If another config already pooled identical content, share that instead.
+	key, err := fileDBKey("geocn|"+app.LoadMode, app.Source, app.localFile)
+	if err == nil {
+		var reader *geoip2.Reader
+		var loaded bool
+		reader, loaded, err = acquireDB(key, func() (*geoip2.Reader, func(), error) {
+			return tempReader, closeTemp, nil
+		})
+		if err == nil && loaded {
+			closeTemp()
+			tempReader = reader
+		}
+	}
+	if err != nil {
+		key = ""
 	}
+	app.swapReader(tempReader, key, closeTemp)
 
 	app.logger.Info("GeoIP database updated successfully", zap.String("file", app.localFile))
 	return nil
@@ -288,12 +482,45 @@ func (app *GeoCNApp) periodicUpdate() {
 					app.logger.Error("update database failed", zap.Error(err))
 				}
 			}
+			app.reloadIfChanged()
+			app.updateOverrides()
 		case <-app.ctx.Done():
 			return
 		}
 	}
 }
 
+// reloadIfChanged loads the cache file when another instance sharing the
+// data directory (whose update this one skipped) has replaced it. The file
+// is only hashed when its stamp has changed.
+func (app *GeoCNApp) reloadIfChanged() {
+	if !isHTTPSource(app.Source) || !app.localStamp.changed(app.localFile) {
+		return
+	}
+	var current string
+	if snap := app.db.acquire(); snap != nil {
+		current = snap.key
+		snap.done()
+	}
+	key, err := fileDBKey("geocn|"+app.LoadMode, app.Source, app.localFile)
+	if err != nil || key == current {
+		return
+	}
+	if err := app.openDatabase(app.localFile); err != nil {
+		app.logger.Warn("failed to reload updated database", zap.String("file", app.localFile), zap.Error(err))
+		return
+	}
+	app.logger.Info("reloaded database updated by another instance", zap.String("file", app.localFile))
+}
+
+func (app *GeoCNApp) updateOverrides() {
+	ctx, cancel := getContextWithTimeout(app.ctx, app.Timeout)
+	defer cancel()
+	if err := app.overrides.update(ctx, app.httpClient, time.Duration(app.Interval)); err != nil {
+		app.logger.Warn("update overrides failed", zap.Error(err))
+	}
+}
+
 // Validate implements caddy.Validator.
 func (app *GeoCNApp) Validate() error {
 	if app.Interval <= 0 {
@@ -304,53 +531,85 @@ func (app *GeoCNApp) Validate() error {
 			return fmt.Errorf("geocn: source file not found: %s", app.Source)
 		}
 	}
+	if app.OverridesSource != "" && !isHTTPSource(app.OverridesSource) {
+		if _, err := os.Stat(app.OverridesSource); err != nil {
+			return fmt.Errorf("geocn: overrides file not found: %s", app.OverridesSource)
+		}
+	}
 	return nil
 }
 
 func (app *GeoCNApp) Cleanup() error {
-	app.lock.Lock()
-	defer app.lock.Unlock()
-
-	if app.dbReader != nil {
-		err := app.dbReader.Close()
-		app.dbReader = nil
-		return err
+	if err := releaseCache(app.cacheKey); err != nil {
+		app.logger.Warn("failed to release cache", zap.Error(err))
 	}
+	app.cacheKey = ""
+
+	app.db.close()
 	return nil
 }
 
 func (app *GeoCNApp) lookupCountry(host string) string {
-	nip, err := netip.ParseAddr(host)
-	if err != nil || !nip.IsValid() || checkPrivateAddr(nip) {
+	nip, ok := app.normalizer.normalize(host)
+	if !ok {
 		return ""
 	}
+	if country, ok := app.overrides.lookup(nip); ok {
+		return country
+	}
+	if country, ok := app.private.resolve(nip, "CN"); ok {
+		return country
+	}
 
 	if app.cache != nil {
-		if country, found := app.cache.Get(host); found {
+		if country, found := app.cache.Get(nip); found {
 			return country
 		}
 	}
 
-	app.lock.RLock()
-	if app.dbReader == nil {
-		app.lock.RUnlock()
+	snap := app.db.acquire()
+	if snap == nil {
 		return ""
 	}
-	record, err := app.dbReader.Country(nip)
-	app.lock.RUnlock()
+	// The snapshot stays pinned until the result is cached: a swap purges
+	// the cache only after the last lookup on the old reader is done, so
+	// its results cannot land in the purged cache.
+	defer snap.done()
+	return app.lookupSnapshot(snap, nip)
+}
 
-	if err != nil || record == nil || !record.HasData() {
-		return ""
+// lookupSnapshot looks nip up in the pinned snapshot and caches the result.
+func (app *GeoCNApp) lookupSnapshot(snap *dbSnapshot[*geoip2.Reader], nip netip.Addr) string {
+	record, err := snap.db.Country(nip)
+
+	// Misses are cached too (under negative_ttl), so repeated traffic from
+	// ranges the database does not know stays off the reader.
+	var country string
+	network := hostPrefix(nip)
+	if err == nil && record != nil {
+		country = record.Country.ISOCode
+		if n := record.Traits.Network; n.IsValid() && n.Addr().Is4() == nip.Is4() {
+			network = n
+		}
 	}
 
-	country := record.Country.ISOCode
-	if app.cache != nil && country != "" {
-		app.cache.Set(host, country)
+	if app.cache != nil {
+		if country != "" {
+			app.cache.Set(network, country)
+		} else {
+			app.cache.SetWithTTL(network, "", time.Duration(app.CacheNegativeTTL))
+		}
 	}
 
 	return country
 }
 
+// internalHop reports whether host is an internal proxy hop that chain
+// matching skips.
+func (app *GeoCNApp) internalHop(host string) bool {
+	return internalHop(app.normalizer, app.overrides, app.private, host)
+}
+
 func (m *GeoCN) Provision(ctx caddy.Context) error {
 	m.logger = ctx.Logger()
 
@@ -368,14 +627,37 @@ func (m *GeoCN) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// Validate implements caddy.Validator.
+func (m *GeoCN) Validate() error {
+	if err := m.ipSource.validate(); err != nil {
+		return fmt.Errorf("geocn matcher: %w", err)
+	}
+	return nil
+}
+
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
-// The geocn matcher has no configuration of its own; all settings
-// are on the global geocn app. Syntax:
+// Database and cache settings are on the global geocn app. Syntax:
 //
-//	geocn
+//	geocn [{
+//	    source          <placeholder>
+//	    source_fallback client_ip|no_match
+//	    chain           any|all|first|last
+//	}]
 func (m *GeoCN) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	// The matcher itself has no configuration - all config is on the app
-	d.Next()
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for n := d.Nesting(); d.NextBlock(n); {
+			ok, err := m.ipSource.unmarshalCaddyfile(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.ArgErr()
+			}
+		}
+	}
 	return nil
 }
 
@@ -389,12 +671,24 @@ func (m *GeoCN) Match(r *http.Request) bool {
 		return false
 	}
 
-	host, raw := extractClientIP(r)
+	if m.Chain != "" {
+		hops := forwardedChain(r, m.app.internalHop)
+		matched := matchChain(m.Chain, hops, func(host string) bool {
+			return m.app.lookupCountry(host) == "CN"
+		})
+		m.logger.Debug("geocn chain match result",
+			zap.Strings("hops", hops),
+			zap.String("chain", m.Chain),
+			zap.Bool("matched", matched))
+		return matched
+	}
+
+	host, raw, client := m.resolve(r)
 	if host == "" {
 		return false
 	}
 
-	country := m.app.lookupCountry(host)
+	country := lookupSource(r, client, countryVarKey, host, m.app.lookupCountry)
 	matched := country == "CN"
 
 	m.logger.Debug("geocn match result",
@@ -412,8 +706,15 @@ func (m *GeoCN) Match(r *http.Request) bool {
 //	        interval 24h
 //	        timeout 30s
 //	        source https://example.com/Country.mmdb
-//	        cache ttl 5m size 10000
+//	        cache ttl 5m negative_ttl 1m size 10000 max_memory 64MiB policy random|lru|tinylfu shards 1 [persist]
 //	        # or: cache off
+//	        private_ips no_match|match|<country>
+//	        private_range <country> <cidr> [<cidr>...]
+//	        nat64_prefixes <prefix> [<prefix>...]
+//	        load_mode memory|mmap
+//	        overrides [<file_or_url>] {
+//	            <cidr> <country>
+//	        }
 //	    }
 //	}
 func parseGeoCNAppCaddyfile(d *caddyfile.Dispenser, _ any) (any, error) {
@@ -446,12 +747,39 @@ func parseGeoCNAppCaddyfile(d *caddyfile.Dispenser, _ any) (any, error) {
 				}
 				app.Source = d.Val()
 			case "cache":
-				if err := parseCacheBlock(d, &app.EnableCache, &app.CacheTTL, &app.CacheMaxSize); err != nil {
+				if err := parseCacheBlock(d, &app.CacheConfig); err != nil {
 					return nil, err
 				}
 				if app.EnableCache != nil && !*app.EnableCache {
 					continue
 				}
+			case "private_ips":
+				if !d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				app.PrivateIPs = d.Val()
+			case "private_range":
+				if err := parsePrivateRange(d, &app.PrivateRanges); err != nil {
+					return nil, err
+				}
+			case "overrides":
+				if err := parseOverridesBlock(d, &app.OverridesSource, &app.Overrides); err != nil {
+					return nil, err
+				}
+			case "load_mode":
+				if !d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				app.LoadMode = d.Val()
+				if d.NextArg() {
+					return nil, d.ArgErr()
+				}
+			case "nat64_prefixes":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return nil, d.ArgErr()
+				}
+				app.NAT64Prefixes = append(app.NAT64Prefixes, args...)
 			default:
 				return nil, d.ArgErr()
 			}
@@ -8,6 +8,8 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -67,8 +69,7 @@ func TestGeoCNAppUpdateGeoFileReplacesReader(t *testing.T) {
 		Source:    srv.URL,
 		localFile: localFile,
 		ctx:       newTestContext(),
-		lock:      &sync.RWMutex{},
-		dbReader:  initialReader,
+		db:        new(dbHolder[*geoip2.Reader]),
 		logger:    zap.NewNop(),
 		httpClient: &http.Client{
 			Timeout: time.Second,
@@ -79,20 +80,20 @@ func TestGeoCNAppUpdateGeoFileReplacesReader(t *testing.T) {
 		},
 	}
 
+	app.swapReader(initialReader, "", func() { initialReader.Close() })
+
 	if err := app.updateGeoFile(); err != nil {
 		t.Fatalf("updateGeoFile failed: %v", err)
 	}
 
-	if app.dbReader == nil {
-		t.Fatal("expected dbReader to be set")
-	}
-	if app.dbReader == initialReader {
+	dbReader := currentDB(t, app.db)
+	if dbReader == initialReader {
 		t.Fatal("expected dbReader to be replaced")
 	}
 
 	if addr, err := netip.ParseAddr("1.1.1.1"); err != nil {
 		t.Fatalf("parse ip: %v", err)
-	} else if _, err := app.dbReader.Country(addr); err != nil {
+	} else if _, err := dbReader.Country(addr); err != nil {
 		t.Fatalf("new reader lookup failed: %v", err)
 	}
 
@@ -114,10 +115,21 @@ func TestGeoCNAppUpdateGeoFileReplacesReader(t *testing.T) {
 	}
 
 	t.Cleanup(func() {
-		app.dbReader.Close()
+		app.Cleanup()
 	})
 }
 
+// currentDB returns the database installed in h.
+func currentDB[T any](t *testing.T, h *dbHolder[T]) T {
+	t.Helper()
+	snap := h.acquire()
+	if snap == nil {
+		t.Fatal("expected a database to be loaded")
+	}
+	defer snap.done()
+	return snap.db
+}
+
 func TestGeoCityUpdateDatabaseReplacesSearcher(t *testing.T) {
 	fixture := fixturePath(t, "ip2region_v4.xdb")
 	if _, err := os.Stat(fixture); err != nil {
@@ -147,8 +159,7 @@ func TestGeoCityUpdateDatabaseReplacesSearcher(t *testing.T) {
 		IPv4Source:    srv.URL,
 		localIPv4File: localFile,
 		ctx:           newTestContext(),
-		lock:          &sync.RWMutex{},
-		searcherIPv4:  initialSearcher,
+		ipv4DB:        new(dbHolder[*xdbSearcher]),
 		logger:        zap.NewNop(),
 		httpClient: &http.Client{
 			Timeout: time.Second,
@@ -159,18 +170,18 @@ func TestGeoCityUpdateDatabaseReplacesSearcher(t *testing.T) {
 		},
 	}
 
+	module.swapSearcher(module.ipv4DB, &xdbSearcher{Searcher: initialSearcher})
+
 	if err := module.updateDatabaseIPv4(); err != nil {
 		t.Fatalf("updateDatabaseIPv4 failed: %v", err)
 	}
 
-	if module.searcherIPv4 == nil {
-		t.Fatal("expected searcherIPv4 to be set")
-	}
-	if module.searcherIPv4 == initialSearcher {
+	searcherIPv4 := currentDB(t, module.ipv4DB)
+	if searcherIPv4.Searcher == initialSearcher {
 		t.Fatal("expected searcherIPv4 to be replaced")
 	}
 
-	if _, err := module.searcherIPv4.SearchByStr("1.1.1.1"); err != nil {
+	if _, err := searcherIPv4.SearchByStr("1.1.1.1"); err != nil {
 		t.Fatalf("new searcher lookup failed: %v", err)
 	}
 
@@ -179,9 +190,7 @@ func TestGeoCityUpdateDatabaseReplacesSearcher(t *testing.T) {
 	}
 
 	t.Cleanup(func() {
-		if module.searcherIPv4 != nil {
-			module.searcherIPv4.Close()
-		}
+		module.Cleanup()
 	})
 }
 
@@ -240,3 +249,675 @@ func TestDownloadFileRejectsInvalidTLS(t *testing.T) {
 		t.Fatalf("expected TLS download to fail due to self-signed certificate")
 	}
 }
+
+func TestPrivatePolicyResolve(t *testing.T) {
+	ranges := map[string][]string{
+		"CN": {"10.8.0.0/16"},
+		"HK": {"10.8.1.0/24", "fd00:1::/32"},
+	}
+
+	tests := []struct {
+		name      string
+		mode      string
+		ip        string
+		want      string
+		wantOK    bool
+		wantMatch bool
+	}{
+		{"public address", "", "1.1.1.1", "", false, false},
+		{"default no_match", "", "192.168.1.1", "", true, false},
+		{"match mode", "match", "127.0.0.1", "CN", true, true},
+		{"fixed value", "JP", "172.16.0.1", "JP", true, false},
+		{"user range", "match", "10.8.2.3", "CN", true, false},
+		{"longest prefix wins", "no_match", "10.8.1.9", "HK", true, false},
+		{"user IPv6 range", "no_match", "fd00:1::1", "HK", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newPrivatePolicy(tt.mode, ranges, validCountryCode)
+			if err != nil {
+				t.Fatalf("newPrivatePolicy: %v", err)
+			}
+			addr := netip.MustParseAddr(tt.ip)
+			got, ok := p.resolve(addr, "CN")
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("resolve(%s) = (%q, %v), want (%q, %v)", tt.ip, got, ok, tt.want, tt.wantOK)
+			}
+			if match := p.matchesAll(addr); match != tt.wantMatch {
+				t.Errorf("matchesAll(%s) = %v, want %v", tt.ip, match, tt.wantMatch)
+			}
+		})
+	}
+
+	if _, err := newPrivatePolicy("", map[string][]string{"CN": {"10.0.0.0"}}, validCountryCode); err == nil {
+		t.Error("expected invalid CIDR to be rejected")
+	}
+	for _, mode := range []string{"no-match", "cn", "China"} {
+		if _, err := newPrivatePolicy(mode, nil, validCountryCode); err == nil {
+			t.Errorf("expected private_ips %q to be rejected", mode)
+		}
+	}
+	if _, err := newPrivatePolicy("广东", nil, validRegion); err == nil {
+		t.Error("expected a bare keyword to be rejected as a fixed region")
+	}
+	if _, err := newPrivatePolicy("中国|0|北京|北京市|内网", map[string][]string{"内网": {"10.0.0.0/8"}}, validRegion); err == nil {
+		t.Error("expected an invalid private range value to be rejected")
+	}
+}
+
+func TestOverridesLoadAndUpdate(t *testing.T) {
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "overrides.txt")
+	if err := os.WriteFile(source, []byte("# CDN egress\n203.0.113.0/24 CN\n198.51.100.0/24 US\n"), 0o600); err != nil {
+		t.Fatalf("write overrides: %v", err)
+	}
+
+	o, err := newOverrides(map[string]string{"198.51.100.0/25": "HK"}, source, validCountryCode)
+	if err != nil {
+		t.Fatalf("newOverrides: %v", err)
+	}
+	if _, ok := o.lookup(netip.MustParseAddr("203.0.113.7")); ok {
+		t.Fatal("expected file entries to be absent before load")
+	}
+	if err := o.load(context.Background(), nil); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	tests := map[string]string{
+		"203.0.113.7":    "CN",
+		"198.51.100.200": "US",
+		"198.51.100.1":   "HK", // inline entry, longer prefix
+	}
+	for ip, want := range tests {
+		if got, ok := o.lookup(netip.MustParseAddr(ip)); !ok || got != want {
+			t.Errorf("lookup(%s) = (%q, %v), want %q", ip, got, ok, want)
+		}
+	}
+
+	if err := os.WriteFile(source, []byte("203.0.113.0/24 JP\n"), 0o600); err != nil {
+		t.Fatalf("rewrite overrides: %v", err)
+	}
+	if err := o.update(context.Background(), nil, time.Hour); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if got, _ := o.lookup(netip.MustParseAddr("203.0.113.7")); got != "JP" {
+		t.Errorf("expected updated override JP, got %q", got)
+	}
+
+	if err := os.WriteFile(source, []byte("not-a-cidr CN\n"), 0o600); err != nil {
+		t.Fatalf("rewrite overrides: %v", err)
+	}
+	if err := o.update(context.Background(), nil, time.Hour); err == nil {
+		t.Error("expected invalid overrides file to be rejected")
+	}
+	if got, _ := o.lookup(netip.MustParseAddr("203.0.113.7")); got != "JP" {
+		t.Errorf("expected previous overrides to be kept, got %q", got)
+	}
+
+	// Values must be valid for the app, inline or from the file.
+	if err := os.WriteFile(source, []byte("# lower case\n203.0.113.0/24 cn\n"), 0o600); err != nil {
+		t.Fatalf("rewrite overrides: %v", err)
+	}
+	if err := o.update(context.Background(), nil, time.Hour); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected the invalid value to be reported with its line, got %v", err)
+	}
+	if _, err := newOverrides(map[string]string{"1.2.3.0/24": "cn"}, "", validCountryCode); err == nil {
+		t.Error("expected a lower-case inline country code to be rejected")
+	}
+	if _, err := newOverrides(map[string]string{"1.2.3.0/24": "中国|上海"}, "", validRegion); err == nil {
+		t.Error("expected a malformed inline region to be rejected")
+	}
+	if _, err := newOverrides(map[string]string{"1.2.3.0/24": "中国|0|上海|上海市|电信"}, "", validRegion); err != nil {
+		t.Errorf("valid region override rejected: %v", err)
+	}
+}
+
+func TestParseOverridesSeparators(t *testing.T) {
+	entries, err := parseOverrides(strings.NewReader("203.0.113.0/24\tCN\n198.51.100.0/24    US  \n"), validCountryCode)
+	if err != nil {
+		t.Fatalf("parseOverrides: %v", err)
+	}
+	if entries[netip.MustParsePrefix("203.0.113.0/24")] != "CN" || entries[netip.MustParsePrefix("198.51.100.0/24")] != "US" {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+	for _, bad := range []string{"203.0.113.0/24", "203.0.113.0/24 CN extra"} {
+		if _, err := parseOverrides(strings.NewReader(bad), validCountryCode); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestCheckPrivateAddr(t *testing.T) {
+	tests := map[string]bool{
+		"10.1.2.3":         true,
+		"100.64.0.1":       true,
+		"100.128.0.1":      false,
+		"192.0.2.10":       true,
+		"198.18.5.5":       true,
+		"198.51.100.1":     true,
+		"203.0.113.9":      true,
+		"192.0.0.9":        false,
+		"240.0.0.1":        true,
+		"255.255.255.255":  true,
+		"::ffff:10.0.0.1":  true,
+		"::ffff:1.1.1.1":   false,
+		"2001:db8::1":      true,
+		"3fff::1":          true,
+		"fd12:3456::1":     true,
+		"fe80::1":          true,
+		"ff02::1":          true,
+		"2001:4:112::1":    false,
+		"2408:8000::1":     false,
+		"1.1.1.1":          false,
+		"114.114.114.114":  false,
+		"64:ff9b:1::1":     true,
+		"2001:2::1":        true,
+		"::1":              true,
+		"::":               true,
+		"0.0.0.0":          true,
+		"169.254.169.254":  true,
+		"172.31.255.255":   true,
+		"172.32.0.1":       false,
+		"192.88.99.1":      true,
+		"224.0.0.251":      true,
+		"2001:4860::8888":  false,
+		"2001:3::1":        false,
+		"5f00::1":          true,
+		"100::1":           true,
+		"192.168.255.255":  true,
+		"127.255.255.254":  true,
+		"2001:0:4136::1":   true, // Teredo itself is only meaningful once unwrapped
+		"64:ff9b::1.1.1.1": false,
+	}
+
+	for ip, want := range tests {
+		if got := checkPrivateAddr(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("checkPrivateAddr(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestUnwrapIPv4(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"1.1.1.1", "1.1.1.1"},
+		{"::ffff:114.114.114.114", "114.114.114.114"},
+		{"64:ff9b::7272:7272", "114.114.114.114"},
+		{"2002:7272:7272::1", "114.114.114.114"},
+		{"2002:0a00:0001::1", "10.0.0.1"},
+		{"2001:0:4136:e378:8000:63bf:8d8d:8d8d", "114.114.114.114"},
+		{"2408:8000::1", "2408:8000::1"},
+	}
+
+	for _, tt := range tests {
+		if got := unwrapIPv4(netip.MustParseAddr(tt.in)); got != netip.MustParseAddr(tt.want) {
+			t.Errorf("unwrapIPv4(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAddrNormalizer(t *testing.T) {
+	n, err := newAddrNormalizer([]string{"2001:db8:100::/40", "2001:db8:122::/96"})
+	if err != nil {
+		t.Fatalf("newAddrNormalizer: %v", err)
+	}
+
+	tests := []struct {
+		in, want string
+	}{
+		{"114.114.114.114", "114.114.114.114"},
+		{"::ffff:114.114.114.114", "114.114.114.114"},
+		{"64:ff9b::114.114.114.114", "114.114.114.114"},
+		{"2001:db8:122::114.114.114.114", "114.114.114.114"},
+		// RFC 6052 /40 layout: IPv4 split around the reserved u octet.
+		{"2001:db8:1c0:2:21::", "192.0.2.33"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"2408:8000::1", "2408:8000::1"},
+	}
+	for _, tt := range tests {
+		got, ok := n.normalize(tt.in)
+		if !ok || got != netip.MustParseAddr(tt.want) {
+			t.Errorf("normalize(%s) = (%s, %v), want %s", tt.in, got, ok, tt.want)
+		}
+	}
+
+	if _, ok := n.normalize("not-an-ip"); ok {
+		t.Error("expected invalid host to be rejected")
+	}
+	if _, err := newAddrNormalizer([]string{"2001:db8::/33"}); err == nil {
+		t.Error("expected unsupported prefix length to be rejected")
+	}
+}
+
+func TestXDBSearcherReportsNetwork(t *testing.T) {
+	fixture := fixturePath(t, "ip2region_v4.xdb")
+	if _, err := os.Stat(fixture); err != nil {
+		t.Fatalf("fixture missing: %v", err)
+	}
+
+	searcher, err := openXDBFromFile(xdb.IPv4, fixture)
+	if err != nil {
+		t.Fatalf("open searcher: %v", err)
+	}
+	t.Cleanup(searcher.Close)
+
+	for _, ip := range []string{"1.1.1.1", "114.114.114.114", "36.110.1.1"} {
+		addr := netip.MustParseAddr(ip)
+		region, network, err := searcher.search(addr)
+		if err != nil {
+			t.Fatalf("search(%s): %v", ip, err)
+		}
+		want, err := searcher.SearchByStr(ip)
+		if err != nil || region != want {
+			t.Fatalf("search(%s) region = %q, want %q (%v)", ip, region, want, err)
+		}
+		if !network.Contains(addr) {
+			t.Fatalf("search(%s) network %s does not contain the address", ip, network)
+		}
+		// Both ends of the reported network must resolve to the same region.
+		for _, edge := range []netip.Addr{network.Masked().Addr(), lastAddr(network)} {
+			if got, _ := searcher.SearchByStr(edge.String()); got != region {
+				t.Errorf("network %s edge %s = %q, want %q", network, edge, got, region)
+			}
+		}
+	}
+}
+
+func TestLookupCountryCachesMisses(t *testing.T) {
+	fixture := fixturePath(t, "Country.mmdb")
+	if _, err := os.Stat(fixture); err != nil {
+		t.Fatalf("fixture missing: %v", err)
+	}
+	reader, err := geoip2.Open(fixture)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+
+	app := &GeoCNApp{
+		CacheConfig: CacheConfig{CacheNegativeTTL: caddy.Duration(time.Minute)},
+		db:          new(dbHolder[*geoip2.Reader]),
+		cache:       newIPCache(100, 5*time.Minute),
+		logger:      zap.NewNop(),
+	}
+	app.swapReader(reader, "", func() { reader.Close() })
+	t.Cleanup(func() { app.Cleanup() })
+
+	if got := app.lookupCountry("9.9.9.9"); got != "" {
+		t.Fatalf("lookupCountry(9.9.9.9) = %q, want empty", got)
+	}
+	// The miss is cached for the whole network the database reported.
+	if v, found := app.cache.Get(netip.MustParseAddr("9.9.9.10")); !found || v != "" {
+		t.Errorf("expected cached miss for 9.9.9.10, got (%q, %v)", v, found)
+	}
+	if got := app.lookupCountry("114.114.114.114"); got != "CN" {
+		t.Errorf("lookupCountry(114.114.114.114) = %q, want CN", got)
+	}
+}
+
+func TestDatabaseSharedAcrossInstances(t *testing.T) {
+	fixture := fixturePath(t, "Country.mmdb")
+	if _, err := os.Stat(fixture); err != nil {
+		t.Fatalf("fixture missing: %v", err)
+	}
+	localFile := filepath.Join(t.TempDir(), "Country.mmdb")
+	copyTestFile(t, fixture, localFile)
+
+	newApp := func() *GeoCNApp {
+		return &GeoCNApp{Source: "shared-test", db: new(dbHolder[*geoip2.Reader]), logger: zap.NewNop()}
+	}
+	oldApp, newerApp := newApp(), newApp()
+	if err := oldApp.openDatabase(localFile); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := newerApp.openDatabase(localFile); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	reader := currentDB(t, newerApp.db)
+	if currentDB(t, oldApp.db) != reader {
+		t.Fatal("expected an unchanged database to share one reader")
+	}
+
+	// Unloading the old config must not close the reader the new one uses.
+	oldApp.Cleanup()
+	if _, err := reader.Country(netip.MustParseAddr("114.114.114.114")); err != nil {
+		t.Fatalf("shared reader closed early: %v", err)
+	}
+	newerApp.Cleanup()
+	if _, err := reader.Country(netip.MustParseAddr("114.114.114.114")); err == nil {
+		t.Fatal("expected the reader to be closed after the last release")
+	}
+}
+
+func TestLoadModes(t *testing.T) {
+	fixture := fixturePath(t, "ip2region_v4.xdb")
+	if _, err := os.Stat(fixture); err != nil {
+		t.Fatalf("fixture missing: %v", err)
+	}
+
+	for _, mode := range []string{loadMemory, loadMmap, loadVectorIndex} {
+		t.Run(mode, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ip2region_v4.xdb")
+			copyTestFile(t, fixture, path)
+
+			s, err := openXDB(mode, xdb.IPv4, path)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			t.Cleanup(s.Close)
+
+			// Replacing the file the way updates do must not disturb the
+			// open searcher.
+			copyTestFile(t, fixture, path)
+
+			var wg sync.WaitGroup
+			for range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range 100 {
+						region, _, err := s.search(netip.MustParseAddr("114.114.114.114"))
+						if err != nil || region != "中国|0|江苏省|南京市|电信" {
+							t.Errorf("search = (%q, %v)", region, err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+
+	// mmdb files are mapped the same way, so updates can replace them too.
+	mmdb := filepath.Join(t.TempDir(), "Country.mmdb")
+	copyTestFile(t, fixturePath(t, "Country.mmdb"), mmdb)
+	reader, closeReader, err := openGeoIP(loadMmap, mmdb)
+	if err != nil {
+		t.Fatalf("open mmdb with mmap: %v", err)
+	}
+	defer closeReader()
+	copyTestFile(t, fixturePath(t, "Country.mmdb"), mmdb)
+	record, err := reader.Country(netip.MustParseAddr("114.114.114.114"))
+	if err != nil || record.Country.ISOCode != "CN" {
+		t.Errorf("mmap Country = (%v, %v), want CN", record, err)
+	}
+
+	if err := checkLoadMode(loadVectorIndex, loadMemory, loadMmap); err == nil {
+		t.Error("expected vector_index to be rejected where unsupported")
+	}
+}
+
+func TestSwapSearcherPurgesOnlyItsFamily(t *testing.T) {
+	app := newTestGeoCityApp(t)
+	app.cache = newCityCache(100, time.Minute)
+	app.cache.Set(netip.MustParsePrefix("114.114.0.0/16"), "v4")
+	app.cache.Set(netip.MustParsePrefix("2001:db8::/32"), "v6")
+
+	s, err := openXDB(loadMemory, xdb.IPv4, fixturePath(t, "ip2region_v4.xdb"))
+	if err != nil {
+		t.Fatalf("open searcher: %v", err)
+	}
+	app.swapSearcher(app.ipv4DB, s)
+
+	if _, ok := app.cache.Get(netip.MustParseAddr("114.114.114.114")); ok {
+		t.Error("expected IPv4 results to be purged after an IPv4 swap")
+	}
+	if v, ok := app.cache.Get(netip.MustParseAddr("2001:db8::1")); !ok || v != "v6" {
+		t.Error("expected IPv6 results to survive an IPv4 swap")
+	}
+}
+
+func TestDBHolderReleasesAfterLastLookup(t *testing.T) {
+	var released []string
+	purged := 0
+	h := new(dbHolder[string])
+	install := func(db, key string) {
+		h.swap(db, key, func() { released = append(released, db) }, func() { purged++ })
+	}
+
+	install("v1", "k1")
+	inflight := h.acquire()
+
+	install("v2", "k2")
+	if len(released) != 0 {
+		t.Fatalf("released %v while a lookup still pins v1", released)
+	}
+	if snap := h.acquire(); snap.db != "v2" {
+		t.Fatalf("acquire = %q, want v2", snap.db)
+	} else {
+		snap.done()
+	}
+
+	inflight.done()
+	if len(released) != 1 || released[0] != "v1" || purged != 1 {
+		t.Fatalf("after last lookup: released %v, purged %d; want [v1], 1", released, purged)
+	}
+
+	// Re-installing identical content keeps cached results.
+	install("v2 again", "k2")
+	if purged != 1 {
+		t.Errorf("purged %d times, want no purge for unchanged content", purged)
+	}
+
+	h.close()
+	if h.acquire() != nil {
+		t.Error("expected no database after close")
+	}
+	if len(released) != 3 || purged != 1 {
+		t.Errorf("after close: released %v, purged %d", released, purged)
+	}
+}
+
+func TestLookupResultFromReplacedDatabaseIsPurged(t *testing.T) {
+	cn := newTestGeoCNApp(t)
+	cn.cache = newIPCache(100, time.Minute)
+	city := newTestGeoCityApp(t)
+	city.cache = newCityCache(100, time.Minute)
+	nip := netip.MustParseAddr("114.114.114.114")
+
+	// Each lookup pins the current database, which is then replaced
+	// before the lookup reads it and caches the result.
+	cnSnap := cn.db.acquire()
+	reader, err := geoip2.Open(fixturePath(t, "Country.mmdb"))
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	cn.swapReader(reader, "", func() { reader.Close() })
+	if got := cn.lookupSnapshot(cnSnap, nip); got != "CN" {
+		t.Fatalf("lookupSnapshot = %q, want CN", got)
+	}
+	cnSnap.done()
+	if _, ok := cn.cache.Get(nip); ok {
+		t.Error("geocn: result from the replaced database survived the purge")
+	}
+
+	citySnap := city.ipv4DB.acquire()
+	s, err := openXDB(loadMemory, xdb.IPv4, fixturePath(t, "ip2region_v4.xdb"))
+	if err != nil {
+		t.Fatalf("open searcher: %v", err)
+	}
+	city.swapSearcher(city.ipv4DB, s)
+	if got := city.searchSnapshot(citySnap, nip); got == "" {
+		t.Fatal("searchSnapshot found no region")
+	}
+	citySnap.done()
+	if _, ok := city.cache.Get(nip); ok {
+		t.Error("geocity: result from the replaced database survived the purge")
+	}
+}
+
+func TestTryLockFileExcludesSecondUpdater(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Country.mmdb")
+
+	unlock, ok, err := tryLockFile(path)
+	if err != nil || !ok {
+		t.Fatalf("first lock: ok=%v err=%v", ok, err)
+	}
+	if _, ok, err := tryLockFile(path); err != nil || ok {
+		t.Fatalf("second lock while held: ok=%v err=%v", ok, err)
+	}
+	unlock()
+
+	unlock, ok, err = tryLockFile(path)
+	if err != nil || !ok {
+		t.Fatalf("lock after release: ok=%v err=%v", ok, err)
+	}
+	unlock()
+}
+
+func TestFileStampChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	var stamp fileStamp
+	if stamp.changed(path) {
+		t.Error("expected a missing file to count as unchanged")
+	}
+	if err := os.WriteFile(path, []byte("v1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !stamp.changed(path) {
+		t.Error("expected the first stat to report a change")
+	}
+	if stamp.changed(path) {
+		t.Error("expected an untouched file to be unchanged")
+	}
+	if err := os.WriteFile(path, []byte("v2 longer"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !stamp.changed(path) {
+		t.Error("expected a rewritten file to be reported")
+	}
+}
+
+func TestStopWaitsForPeriodicUpdate(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(started) })
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	overrides, err := newOverrides(nil, "", validCountryCode)
+	if err != nil {
+		t.Fatalf("newOverrides: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	app := &GeoCNApp{
+		Source:     srv.URL + "/Country.mmdb",
+		Interval:   caddy.Duration(10 * time.Millisecond),
+		Timeout:    caddy.Duration(time.Minute),
+		ctx:        caddy.Context{Context: ctx},
+		cancel:     cancel,
+		wg:         new(sync.WaitGroup),
+		db:         new(dbHolder[*geoip2.Reader]),
+		overrides:  overrides,
+		localFile:  filepath.Join(t.TempDir(), "Country.mmdb"),
+		httpClient: srv.Client(),
+		logger:     zap.NewNop(),
+	}
+
+	var mu sync.Mutex
+	var events []string
+	record := func(e string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+	app.wg.Go(func() {
+		app.periodicUpdate()
+		record("updater exited")
+	})
+
+	// The first tick starts a download that blocks in the handler.
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("update never started")
+	}
+	record("update in flight")
+	if err := app.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	record("stop returned")
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"update in flight", "updater exited", "stop returned"}
+	if !slices.Equal(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+}
+
+func newTestGeoCNApp(t *testing.T) *GeoCNApp {
+	t.Helper()
+	fixture := fixturePath(t, "Country.mmdb")
+	if _, err := os.Stat(fixture); err != nil {
+		t.Fatalf("fixture missing: %v", err)
+	}
+	reader, err := geoip2.Open(fixture)
+	if err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	app := &GeoCNApp{db: new(dbHolder[*geoip2.Reader]), logger: zap.NewNop()}
+	app.swapReader(reader, "", func() { reader.Close() })
+	t.Cleanup(func() { app.Cleanup() })
+	return app
+}
+
+func newTestGeoCityApp(t *testing.T) *GeoCityApp {
+	t.Helper()
+	fixture := fixturePath(t, "ip2region_v4.xdb")
+	if _, err := os.Stat(fixture); err != nil {
+		t.Fatalf("fixture missing: %v", err)
+	}
+	s, err := openXDB(loadMemory, xdb.IPv4, fixture)
+	if err != nil {
+		t.Fatalf("open searcher: %v", err)
+	}
+	app := &GeoCityApp{
+		ipv4DB: new(dbHolder[*xdbSearcher]),
+		ipv6DB: new(dbHolder[*xdbSearcher]),
+		logger: zap.NewNop(),
+	}
+	app.swapSearcher(app.ipv4DB, s)
+	t.Cleanup(func() { app.Cleanup() })
+	return app
+}
+
+func TestParseRegion(t *testing.T) {
+	tests := []struct {
+		region string
+		want   regionInfo
+	}{
+		{"中国|0|江苏省|南京市|电信", regionInfo{"中国", "江苏省", "南京市", "电信"}},
+		{"美国|0|0|0|Level3", regionInfo{Country: "美国", ISP: "Level3"}},
+		{"中国|广东省|深圳市|移动", regionInfo{"中国", "广东省", "深圳市", "移动"}},
+		{"", regionInfo{}},
+	}
+	for _, tt := range tests {
+		if got := parseRegion(tt.region); got != tt.want {
+			t.Errorf("parseRegion(%q) = %+v, want %+v", tt.region, got, tt.want)
+		}
+	}
+}
+
+func TestGeoCityMatches(t *testing.T) {
+	app := newTestGeoCityApp(t)
+	g := &GeoCity{app: app, allKeywords: []string{"江苏"}}
+
+	for _, tt := range []struct {
+		host string
+		want bool
+	}{
+		{"114.114.114.114", true}, // 中国|0|江苏省|南京市|电信
+		{"8.8.8.8", false},        // outside China
+		{"10.0.0.1", false},       // private, private_ips not "match"
+	} {
+		if got := g.matches(tt.host, app.lookupRegion(tt.host)); got != tt.want {
+			t.Errorf("matches(%s) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package geocn
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+var (
+	_ caddy.Module                = (*GeoDoH)(nil)
+	_ caddy.Provisioner           = (*GeoDoH)(nil)
+	_ caddy.Validator             = (*GeoDoH)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GeoDoH)(nil)
+	_ caddyfile.Unmarshaler       = (*GeoDoH)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(GeoDoH{})
+	httpcaddyfile.RegisterHandlerDirective("geo_doh", parseGeoDoHCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("geo_doh", httpcaddyfile.Before, "reverse_proxy")
+}
+
+// dnsMessageType is the media type of RFC 8484 DNS messages.
+const dnsMessageType = "application/dns-message"
+
+// maxDNSMessageSize is the largest DNS message a request may carry.
+const maxDNSMessageSize = dns.MaxMsgSize
+
+// GeoDoH answers DNS-over-HTTPS queries (RFC 8484) by location, for
+// split-horizon DNS without a separate geo-DNS server. The location is that
+// of the EDNS Client Subnet (RFC 7871) in the query, or of the client IP
+// when the query has none.
+//
+// Every query sets the placeholders {geo_doh.qname}, {geo_doh.qtype},
+// {geo_doh.subnet}, {geo_doh.country}, {geo_doh.region},
+// {geo_doh.province} and {geo_doh.city}. A query is answered directly from
+// the first set that matches the location and has records for its name,
+// or else from Default if that has records for the name; other queries are
+// passed to the next handler, e.g. a reverse_proxy to a recursive resolver
+// that can use the placeholders.
+type GeoDoH struct {
+	Answers []GeoAnswerSet `json:"answers,omitempty"`
+	// Default records answer names that no set matching the location has
+	// records for.
+	Default []string `json:"default,omitempty"`
+
+	geoLocator
+	defaults recordSet
+	logger   *zap.Logger
+}
+
+// GeoAnswerSet holds the records served to clients from one country or
+// region.
+type GeoAnswerSet struct {
+	// Country is an ISO 3166-1 alpha-2 code, resolved by the geocn app.
+	Country string `json:"country,omitempty"`
+	// Region is a geocity region keyword, resolved by the geocity app.
+	Region string `json:"region,omitempty"`
+	// Records are resource records in zone file format, e.g.
+	// "www.example.com. 300 IN A 192.0.2.1".
+	Records []string `json:"records,omitempty"`
+
+	parsed recordSet
+}
+
+// recordSet holds parsed records and their canonical owner names.
+type recordSet struct {
+	rrs   []dns.RR
+	names map[string]struct{}
+}
+
+// has reports whether the set has records owned by the canonical name.
+func (s recordSet) has(name string) bool {
+	_, ok := s.names[name]
+	return ok
+}
+
+func (s GeoAnswerSet) match(loc location) bool {
+	if s.Country != "" {
+		return loc.match([]string{s.Country}, nil)
+	}
+	return loc.match(nil, []string{s.Region})
+}
+
+func (GeoDoH) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geo_doh",
+		New: func() caddy.Module { return new(GeoDoH) },
+	}
+}
+
+func (h *GeoDoH) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger()
+	if err := h.loadRecords(); err != nil {
+		return err
+	}
+
+	var needCN, needCity bool
+	for _, set := range h.Answers {
+		needCN = needCN || set.Country != ""
+		needCity = needCity || set.Region != ""
+	}
+	// Without answer sets the handler only provides placeholders, so both
+	// apps are needed for them to be useful.
+	if len(h.Answers) == 0 {
+		needCN, needCity = true, true
+	}
+	return h.provision(ctx, needCN, needCity)
+}
+
+// loadRecords parses the records of the answer sets and Default.
+func (h *GeoDoH) loadRecords() error {
+	for i := range h.Answers {
+		set := &h.Answers[i]
+		set.Country = strings.ToUpper(set.Country)
+		parsed, err := parseRecords(set.Records)
+		if err != nil {
+			return fmt.Errorf("answer set %d: %w", i, err)
+		}
+		set.parsed = parsed
+	}
+	var err error
+	if h.defaults, err = parseRecords(h.Default); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	return nil
+}
+
+// parseRecords parses zone file records.
+func parseRecords(records []string) (recordSet, error) {
+	set := recordSet{
+		rrs:   make([]dns.RR, 0, len(records)),
+		names: make(map[string]struct{}),
+	}
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return recordSet{}, fmt.Errorf("invalid record %q: %w", s, err)
+		}
+		if rr == nil {
+			return recordSet{}, fmt.Errorf("empty record %q", s)
+		}
+		set.names[dns.CanonicalName(rr.Header().Name)] = struct{}{}
+		set.rrs = append(set.rrs, rr)
+	}
+	return set, nil
+}
+
+// Validate implements caddy.Validator.
+func (h *GeoDoH) Validate() error {
+	for i, s := range h.Answers {
+		if (s.Country == "") == (s.Region == "") {
+			return fmt.Errorf("geo_doh: answer set %d must set exactly one of country or region", i)
+		}
+		if len(s.Records) == 0 {
+			return fmt.Errorf("geo_doh: answer set %d has no records", i)
+		}
+	}
+	if len(h.Answers) == 0 && len(h.Default) > 0 {
+		return fmt.Errorf("geo_doh: default records require at least one answer set")
+	}
+	return nil
+}
+
+func (h *GeoDoH) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	query, err := readDNSMessage(r)
+	if err != nil {
+		return err
+	}
+	if len(query.Question) != 1 || query.Opcode != dns.OpcodeQuery {
+		return h.writeMessage(w, new(dns.Msg).SetRcode(query, dns.RcodeFormatError), false)
+	}
+	q := query.Question[0]
+
+	subnet, ecs := clientSubnet(query)
+	var loc location
+	if ecs != nil {
+		loc = h.locateHost(subnet.Addr().String())
+	} else {
+		host, _ := extractClientIP(r)
+		if addr, err := netip.ParseAddr(host); err == nil {
+			subnet = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		loc = h.locate(r)
+	}
+
+	info := parseRegion(loc.region)
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("geo_doh.qname", q.Name)
+	repl.Set("geo_doh.qtype", dns.TypeToString[q.Qtype])
+	if subnet.IsValid() {
+		repl.Set("geo_doh.subnet", subnet.String())
+	} else {
+		repl.Set("geo_doh.subnet", "")
+	}
+	repl.Set("geo_doh.country", loc.country)
+	repl.Set("geo_doh.region", loc.region)
+	repl.Set("geo_doh.province", info.Province)
+	repl.Set("geo_doh.city", info.City)
+
+	rrs, set := h.answer(dns.CanonicalName(q.Name), loc)
+	if set == "" {
+		return next.ServeHTTP(w, r)
+	}
+
+	h.logger.Debug("geo doh answer",
+		zap.String("qname", q.Name),
+		zap.String("qtype", dns.TypeToString[q.Qtype]),
+		zap.Stringer("subnet", subnet),
+		zap.String("country", loc.country),
+		zap.String("region", loc.region),
+		zap.String("answer_set", set))
+
+	resp := new(dns.Msg).SetReply(query)
+	resp.Authoritative = true
+	resp.Answer = selectRecords(rrs, q)
+	if query.IsEdns0() != nil {
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		if ecs != nil {
+			// The answer depends on the whole source prefix.
+			echo := *ecs
+			echo.SourceScope = ecs.SourceNetmask
+			opt := resp.IsEdns0()
+			opt.Option = append(opt.Option, &echo)
+		}
+	}
+	// Without a client subnet the answer depends on the client IP, which
+	// is not part of the request a shared cache keys on.
+	return h.writeMessage(w, resp, ecs == nil)
+}
+
+// answer returns the records for the canonical name at loc and the name
+// of the set they come from: the first answer set matching loc with
+// records for name, then Default. set is empty if neither has the name.
+func (h *GeoDoH) answer(name string, loc location) (rrs []dns.RR, set string) {
+	for i, s := range h.Answers {
+		if s.parsed.has(name) && s.match(loc) {
+			return s.parsed.rrs, strconv.Itoa(i)
+		}
+	}
+	if h.defaults.has(name) {
+		return h.defaults.rrs, "default"
+	}
+	return nil, ""
+}
+
+// selectRecords returns the records of rrs answering q: those with its name
+// and type, or a CNAME for the name.
+func selectRecords(rrs []dns.RR, q dns.Question) []dns.RR {
+	var answer []dns.RR
+	name := dns.CanonicalName(q.Name)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if dns.CanonicalName(hdr.Name) != name {
+			continue
+		}
+		if hdr.Rrtype == q.Qtype || hdr.Rrtype == dns.TypeCNAME {
+			rr = dns.Copy(rr)
+			// Answer with the name as asked, keeping its case.
+			rr.Header().Name = q.Name
+			answer = append(answer, rr)
+		}
+	}
+	return answer
+}
+
+// writeMessage writes m as a DNS message response, cacheable for the
+// lowest TTL of its answers as RFC 8484 recommends. A private response
+// may only be cached by the client itself.
+func (h *GeoDoH) writeMessage(w http.ResponseWriter, m *dns.Msg, private bool) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("packing dns response: %w", err))
+	}
+	if len(m.Answer) > 0 {
+		ttl := m.Answer[0].Header().Ttl
+		for _, rr := range m.Answer[1:] {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+		cacheControl := "max-age=" + strconv.FormatUint(uint64(ttl), 10)
+		if private {
+			cacheControl = "private, " + cacheControl
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(buf)
+	return err
+}
+
+// readDNSMessage decodes the DNS query of an RFC 8484 request: the dns
+// query parameter of a GET, or the body of a POST.
+func readDNSMessage(r *http.Request) (*dns.Msg, error) {
+	var buf []byte
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("missing dns query parameter"))
+		}
+		var err error
+		if buf, err = base64.RawURLEncoding.DecodeString(param); err != nil {
+			return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid dns query parameter: %w", err))
+		}
+	case http.MethodPost:
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != dnsMessageType {
+			return nil, caddyhttp.Error(http.StatusUnsupportedMediaType, fmt.Errorf("content type must be %s", dnsMessageType))
+		}
+		var err error
+		if buf, err = io.ReadAll(io.LimitReader(r.Body, maxDNSMessageSize+1)); err != nil {
+			return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("reading dns message: %w", err))
+		}
+		if len(buf) > maxDNSMessageSize {
+			return nil, caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("dns message too large"))
+		}
+		// Queries not answered here are passed on, e.g. to reverse_proxy.
+		r.Body = io.NopCloser(bytes.NewReader(buf))
+	default:
+		return nil, caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid dns message: %w", err))
+	}
+	return m, nil
+}
+
+// clientSubnet returns the EDNS Client Subnet of m and its option. A
+// missing option or a zero source prefix, which asks not to use the
+// client's address, yields a nil option.
+func clientSubnet(m *dns.Msg) (netip.Prefix, *dns.EDNS0_SUBNET) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return netip.Prefix{}, nil
+	}
+	for _, o := range opt.Option {
+		ecs, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok || ecs.SourceNetmask == 0 {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ecsAddress(ecs))
+		if !ok {
+			continue
+		}
+		prefix, err := addr.Unmap().Prefix(int(ecs.SourceNetmask))
+		if err != nil {
+			continue
+		}
+		return prefix, ecs
+	}
+	return netip.Prefix{}, nil
+}
+
+// ecsAddress returns the address of ecs in the length of its family.
+func ecsAddress(ecs *dns.EDNS0_SUBNET) net.IP {
+	if ecs.Family == 1 {
+		return ecs.Address.To4()
+	}
+	return ecs.Address.To16()
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	geo_doh {
+//	    country <code> {
+//	        <record>
+//	        ...
+//	    }
+//	    region <keyword> {
+//	        <record>
+//	    }
+//	    default {
+//	        <record>
+//	    }
+//	}
+//
+// Each record is one line in zone file format, e.g.
+// www.example.com. 300 IN A 192.0.2.1.
+func (h *GeoDoH) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for n := d.Nesting(); d.NextBlock(n); {
+			switch d.Val() {
+			case "country", "region":
+				kind := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				set := GeoAnswerSet{}
+				if kind == "country" {
+					set.Country = d.Val()
+				} else {
+					set.Region = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				set.Records = parseRecordLines(d)
+				h.Answers = append(h.Answers, set)
+			case "default":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Default = append(h.Default, parseRecordLines(d)...)
+			default:
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseRecordLines reads a block with one zone file record per line.
+func parseRecordLines(d *caddyfile.Dispenser) []string {
+	var records []string
+	for n := d.Nesting(); d.NextBlock(n); {
+		records = append(records, strings.Join(append([]string{d.Val()}, d.RemainingArgs()...), " "))
+	}
+	return records
+}
+
+func parseGeoDoHCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	g := new(GeoDoH)
+	err := g.UnmarshalCaddyfile(h.Dispenser)
+	return g, err
+}
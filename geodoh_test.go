@@ -0,0 +1,279 @@
+package geocn
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// serveDoH sends q to h as an RFC 8484 POST from remoteAddr.
+func serveDoH(t *testing.T, h *GeoDoH, q *dns.Msg, remoteAddr string) (*httptest.ResponseRecorder, *caddy.Replacer) {
+	t.Helper()
+	buf, err := q.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", dnsMessageType)
+	r.RemoteAddr = remoteAddr
+	repl := caddy.NewReplacer()
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	w := httptest.NewRecorder()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		body, _ := io.ReadAll(r.Body)
+		if !bytes.Equal(body, buf) {
+			t.Error("expected the query body to be passed on")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+	if err := h.ServeHTTP(w, r, next); err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	return w, repl
+}
+
+func dohAnswer(t *testing.T, w *httptest.ResponseRecorder) *dns.Msg {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != dnsMessageType {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(w.Body.Bytes()); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	return m
+}
+
+func ecsQuery(name string, qtype uint16, subnet string) *dns.Msg {
+	q := new(dns.Msg).SetQuestion(name, qtype)
+	if subnet != "" {
+		prefix := netip.MustParsePrefix(subnet)
+		q.SetEdns0(dns.DefaultMsgSize, false)
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(prefix.Bits()),
+			Address:       prefix.Addr().AsSlice(),
+		})
+	}
+	return q
+}
+
+func TestGeoDoH(t *testing.T) {
+	h := &GeoDoH{
+		Answers: []GeoAnswerSet{
+			{Country: "cn", Records: []string{"www.example.com. 60 IN A 192.0.2.1"}},
+			{Region: "江苏", Records: []string{"www.example.com. 60 IN A 192.0.2.2"}},
+		},
+		Default:    []string{"www.example.com. 300 IN A 198.51.100.1", "www.example.com. 300 IN AAAA 2001:db8::1"},
+		geoLocator: geoLocator{cn: newTestGeoCNApp(t), city: newTestGeoCityApp(t)},
+		logger:     zap.NewNop(),
+	}
+	if err := h.loadRecords(); err != nil {
+		t.Fatalf("loadRecords: %v", err)
+	}
+	if err := h.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	firstA := func(m *dns.Msg) string {
+		for _, rr := range m.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				return a.A.String()
+			}
+		}
+		return ""
+	}
+
+	// The client subnet decides the answer, not the resolver's address.
+	w, repl := serveDoH(t, h, ecsQuery("WWW.example.com.", dns.TypeA, "114.114.114.0/24"), "9.9.9.9:53")
+	m := dohAnswer(t, w)
+	if got := firstA(m); got != "192.0.2.1" {
+		t.Errorf("CN subnet answer = %q", got)
+	}
+	if m.Answer[0].Header().Name != "WWW.example.com." {
+		t.Errorf("answer name = %q, want the name as asked", m.Answer[0].Header().Name)
+	}
+	if w.Header().Get("Cache-Control") != "max-age=60" {
+		t.Errorf("Cache-Control = %q", w.Header().Get("Cache-Control"))
+	}
+	if opt := m.IsEdns0(); opt == nil || len(opt.Option) != 1 ||
+		opt.Option[0].(*dns.EDNS0_SUBNET).SourceScope != 24 {
+		t.Errorf("expected the client subnet echoed with scope 24, got %v", m.Extra)
+	}
+	if v, _ := repl.GetString("geo_doh.subnet"); v != "114.114.114.0/24" {
+		t.Errorf("subnet placeholder = %q", v)
+	}
+	if v, _ := repl.GetString("geo_doh.province"); v != "江苏省" {
+		t.Errorf("province placeholder = %q", v)
+	}
+
+	// Without a client subnet the client IP is used; unknown locations get
+	// the default records.
+	w, _ = serveDoH(t, h, ecsQuery("www.example.com.", dns.TypeA, ""), "114.114.114.114:1234")
+	if got := firstA(dohAnswer(t, w)); got != "192.0.2.1" {
+		t.Errorf("CN client answer = %q", got)
+	}
+	// The answer depends on the client IP, so shared caches must not keep it.
+	if w.Header().Get("Cache-Control") != "private, max-age=60" {
+		t.Errorf("Cache-Control without a client subnet = %q", w.Header().Get("Cache-Control"))
+	}
+	w, _ = serveDoH(t, h, ecsQuery("www.example.com.", dns.TypeAAAA, "8.8.8.0/24"), "114.114.114.114:1234")
+	m = dohAnswer(t, w)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.AAAA).AAAA.String() != "2001:db8::1" {
+		t.Errorf("default AAAA answer = %v", m.Answer)
+	}
+
+	// A set without records of the asked type answers NODATA.
+	w, _ = serveDoH(t, h, ecsQuery("www.example.com.", dns.TypeAAAA, "114.114.114.0/24"), "9.9.9.9:53")
+	if m = dohAnswer(t, w); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("expected NODATA, got rcode %d answers %v", m.Rcode, m.Answer)
+	}
+
+	// Other names go to the next handler with the placeholders set.
+	w, repl = serveDoH(t, h, ecsQuery("other.example.com.", dns.TypeA, "114.114.114.0/24"), "9.9.9.9:53")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected the query to be passed on, got %d", w.Code)
+	}
+	if v, _ := repl.GetString("geo_doh.country"); v != "CN" {
+		t.Errorf("country placeholder = %q", v)
+	}
+}
+
+func TestGeoDoHPerSetNames(t *testing.T) {
+	h := &GeoDoH{
+		Answers: []GeoAnswerSet{
+			{Country: "CN", Records: []string{"www.example.com. 60 IN A 192.0.2.1"}},
+			{Region: "江苏", Records: []string{"api.example.com. 60 IN A 192.0.2.2"}},
+		},
+		Default:    []string{"www.example.com. 300 IN A 198.51.100.1"},
+		geoLocator: geoLocator{cn: newTestGeoCNApp(t), city: newTestGeoCityApp(t)},
+		logger:     zap.NewNop(),
+	}
+	if err := h.loadRecords(); err != nil {
+		t.Fatalf("loadRecords: %v", err)
+	}
+
+	// The CN set has no records for api, so the next matching set owning
+	// the name answers instead of an empty CN answer.
+	w, _ := serveDoH(t, h, ecsQuery("api.example.com.", dns.TypeA, "114.114.114.0/24"), "9.9.9.9:53")
+	if m := dohAnswer(t, w); len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("api answer for a Jiangsu client = %v", m.Answer)
+	}
+
+	// A matching set without the name falls back to Default.
+	h.Answers[1].Records = []string{"www.example.com. 60 IN A 192.0.2.2"}
+	h.Answers[0].Records = []string{"api.example.com. 60 IN A 192.0.2.1"}
+	h.Answers[1].Region = "广东"
+	if err := h.loadRecords(); err != nil {
+		t.Fatalf("loadRecords: %v", err)
+	}
+	w, _ = serveDoH(t, h, ecsQuery("www.example.com.", dns.TypeA, "114.114.114.0/24"), "9.9.9.9:53")
+	if m := dohAnswer(t, w); len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "198.51.100.1" {
+		t.Errorf("www answer for a CN client = %v, want the default record", m.Answer)
+	}
+
+	// Names only a non-matching set owns go to the next handler.
+	w, _ = serveDoH(t, h, ecsQuery("api.example.com.", dns.TypeA, "8.8.8.0/24"), "9.9.9.9:53")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected api for a US client to be passed on, got %d", w.Code)
+	}
+}
+
+func TestGeoDoHRequests(t *testing.T) {
+	h := &GeoDoH{
+		Answers:    []GeoAnswerSet{{Country: "CN", Records: []string{"www.example.com. 60 IN A 192.0.2.1"}}},
+		geoLocator: geoLocator{cn: newTestGeoCNApp(t)},
+		logger:     zap.NewNop(),
+	}
+	if err := h.loadRecords(); err != nil {
+		t.Fatalf("loadRecords: %v", err)
+	}
+	serve := func(r *http.Request) (*httptest.ResponseRecorder, error) {
+		r.RemoteAddr = "114.114.114.114:1234"
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		w := httptest.NewRecorder()
+		return w, h.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil }))
+	}
+	status := func(err error) int {
+		var he caddyhttp.HandlerError
+		if errors.As(err, &he) {
+			return he.StatusCode
+		}
+		return 0
+	}
+
+	buf, _ := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA).Pack()
+	w, err := serve(httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(buf), nil))
+	if err != nil || len(dohAnswer(t, w).Answer) != 1 {
+		t.Errorf("GET query: %v", err)
+	}
+
+	if _, err := serve(httptest.NewRequest(http.MethodGet, "/dns-query", nil)); status(err) != http.StatusBadRequest {
+		t.Errorf("missing dns parameter: %v", err)
+	}
+	if _, err := serve(httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(buf))); status(err) != http.StatusUnsupportedMediaType {
+		t.Errorf("POST without content type: %v", err)
+	}
+	if _, err := serve(httptest.NewRequest(http.MethodGet, "/dns-query?dns=AAAA", nil)); status(err) != http.StatusBadRequest {
+		t.Errorf("truncated message: %v", err)
+	}
+
+	noQuestion, _ := new(dns.Msg).Pack()
+	w, err = serve(httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(noQuestion), nil))
+	if err != nil || dohAnswer(t, w).Rcode != dns.RcodeFormatError {
+		t.Errorf("expected FORMERR for a query without question: %v", err)
+	}
+}
+
+func TestGeoDoHCaddyfile(t *testing.T) {
+	var h GeoDoH
+	err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geo_doh {
+		country CN {
+			www.example.com. 60 IN A 192.0.2.1
+			www.example.com. 60 IN AAAA 2001:db8::1
+		}
+		region 广东 {
+			www.example.com. 60 IN CNAME gd.example.com.
+		}
+		default {
+			www.example.com. 300 IN A 198.51.100.1
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if len(h.Answers) != 2 || h.Answers[0].Country != "CN" || h.Answers[1].Region != "广东" ||
+		len(h.Answers[0].Records) != 2 || h.Answers[0].Records[1] != "www.example.com. 60 IN AAAA 2001:db8::1" ||
+		len(h.Default) != 1 {
+		t.Errorf("unexpected config: %+v", h)
+	}
+	if err := h.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	if err := h.loadRecords(); err != nil {
+		t.Errorf("loadRecords: %v", err)
+	}
+
+	bad := GeoDoH{Answers: []GeoAnswerSet{{Country: "CN", Records: []string{"www.example.com. IN A not-an-ip"}}}}
+	if err := bad.loadRecords(); err == nil {
+		t.Error("expected an invalid record to be rejected")
+	}
+	if err := (&GeoDoH{Answers: []GeoAnswerSet{{Country: "CN", Region: "广东", Records: []string{"x. A 192.0.2.1"}}}}).Validate(); err == nil {
+		t.Error("expected a set with both country and region to be rejected")
+	}
+}
@@ -0,0 +1,276 @@
+package geocn
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+var (
+	_ caddy.Module                = (*Geofence)(nil)
+	_ caddy.Provisioner           = (*Geofence)(nil)
+	_ caddy.Validator             = (*Geofence)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Geofence)(nil)
+	_ caddyfile.Unmarshaler       = (*Geofence)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(Geofence{})
+	httpcaddyfile.RegisterHandlerDirective("geofence", parseGeofenceCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("geofence", httpcaddyfile.Before, "basic_auth")
+}
+
+// Geofence allows or blocks requests by client location. Country codes are
+// resolved with the geocn app and region keywords with the geocity app; only
+// the apps the rules refer to are loaded.
+//
+// Deny rules are checked first. When allow rules are configured, a request
+// must match one of them to pass, so clients whose location is unknown are
+// blocked. Blocked requests get the configured response; the resolved
+// location is available as {geofence.country} and {geofence.region}.
+type Geofence struct {
+	Allow GeofenceRules `json:"allow,omitempty"`
+	Deny  GeofenceRules `json:"deny,omitempty"`
+
+	// StatusCode of the block response. Defaults to 403, or 302 with Redirect.
+	StatusCode int `json:"status_code,omitempty"`
+	// Body of the block response; placeholders are expanded.
+	Body string `json:"body,omitempty"`
+	// BodyFile is read at provision time and used instead of Body.
+	BodyFile string `json:"body_file,omitempty"`
+	// RetryAfter, if set, is sent as the Retry-After header in seconds.
+	RetryAfter caddy.Duration `json:"retry_after,omitempty"`
+	// Redirect sends blocked clients to this URL instead of a body.
+	Redirect string `json:"redirect,omitempty"`
+
+	geoLocator
+	body        string
+	contentType string
+	logger      *zap.Logger
+}
+
+// GeofenceRules is one set of allow or deny rules.
+type GeofenceRules struct {
+	// Countries are ISO 3166-1 alpha-2 codes, resolved by the geocn app.
+	Countries []string `json:"countries,omitempty"`
+	// Regions are geocity region keywords, resolved by the geocity app.
+	Regions []string `json:"regions,omitempty"`
+}
+
+func (r GeofenceRules) empty() bool {
+	return len(r.Countries) == 0 && len(r.Regions) == 0
+}
+
+func (r GeofenceRules) match(loc location) bool {
+	return loc.match(r.Countries, r.Regions)
+}
+
+func (Geofence) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geofence",
+		New: func() caddy.Module { return new(Geofence) },
+	}
+}
+
+func (g *Geofence) Provision(ctx caddy.Context) error {
+	g.logger = ctx.Logger()
+
+	for _, rules := range []*GeofenceRules{&g.Allow, &g.Deny} {
+		for i, c := range rules.Countries {
+			rules.Countries[i] = strings.ToUpper(c)
+		}
+	}
+
+	needCN := len(g.Allow.Countries) > 0 || len(g.Deny.Countries) > 0
+	needCity := len(g.Allow.Regions) > 0 || len(g.Deny.Regions) > 0
+	if err := g.provision(ctx, needCN, needCity); err != nil {
+		return err
+	}
+
+	g.body = g.Body
+	if g.BodyFile != "" {
+		data, err := os.ReadFile(g.BodyFile)
+		if err != nil {
+			return fmt.Errorf("read body_file: %w", err)
+		}
+		g.body = string(data)
+		g.contentType = mime.TypeByExtension(filepath.Ext(g.BodyFile))
+	}
+	if g.contentType == "" {
+		g.contentType = "text/plain; charset=utf-8"
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (g *Geofence) Validate() error {
+	if g.Allow.empty() && g.Deny.empty() {
+		return fmt.Errorf("geofence: at least one allow or deny rule must be specified")
+	}
+	if g.StatusCode != 0 && (g.StatusCode < 100 || g.StatusCode > 999) {
+		return fmt.Errorf("geofence: invalid status code %d", g.StatusCode)
+	}
+	if g.Redirect != "" {
+		if g.Body != "" || g.BodyFile != "" {
+			return fmt.Errorf("geofence: redirect cannot be combined with body or body_file")
+		}
+		if g.StatusCode != 0 && (g.StatusCode < 300 || g.StatusCode > 399) {
+			return fmt.Errorf("geofence: redirect requires a 3xx status code, got %d", g.StatusCode)
+		}
+	}
+	if g.Body != "" && g.BodyFile != "" {
+		return fmt.Errorf("geofence: body and body_file are mutually exclusive")
+	}
+	return nil
+}
+
+func (g *Geofence) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	_, raw := extractClientIP(r)
+	loc := g.locate(r)
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set("geofence.country", loc.country)
+	repl.Set("geofence.region", loc.region)
+
+	allowed := !g.Deny.match(loc) &&
+		(g.Allow.empty() || g.Allow.match(loc))
+
+	g.logger.Debug("geofence result",
+		zap.String("client_ip", raw),
+		zap.String("country", loc.country),
+		zap.String("region", loc.region),
+		zap.Bool("allowed", allowed))
+
+	if allowed {
+		return next.ServeHTTP(w, r)
+	}
+	return g.block(w, repl)
+}
+
+// block writes the configured response for a rejected request.
+func (g *Geofence) block(w http.ResponseWriter, repl *caddy.Replacer) error {
+	if g.RetryAfter > 0 {
+		secs := math.Ceil(time.Duration(g.RetryAfter).Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(int(secs)))
+	}
+
+	status := g.StatusCode
+	if g.Redirect != "" {
+		if status == 0 {
+			status = http.StatusFound
+		}
+		w.Header().Set("Location", repl.ReplaceKnown(g.Redirect, ""))
+		w.WriteHeader(status)
+		return nil
+	}
+
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	if g.body == "" {
+		w.WriteHeader(status)
+		return nil
+	}
+	w.Header().Set("Content-Type", g.contentType)
+	w.WriteHeader(status)
+	_, err := io.WriteString(w, repl.ReplaceKnown(g.body, ""))
+	return err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	geofence {
+//	    allow country <code> [<code>...]
+//	    allow region  <keyword> [<keyword>...]
+//	    deny  country <code> [<code>...]
+//	    deny  region  <keyword> [<keyword>...]
+//	    status      <code>
+//	    body        <text>
+//	    body_file   <path>
+//	    retry_after <duration>
+//	    redirect    <url>
+//	}
+func (g *Geofence) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for n := d.Nesting(); d.NextBlock(n); {
+			switch d.Val() {
+			case "allow", "deny":
+				rules := &g.Allow
+				if d.Val() == "deny" {
+					rules = &g.Deny
+				}
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				kind := d.Val()
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				switch kind {
+				case "country":
+					rules.Countries = append(rules.Countries, args...)
+				case "region":
+					rules.Regions = append(rules.Regions, args...)
+				default:
+					return d.Errf("unknown geofence rule type %q (want country or region)", kind)
+				}
+			case "status":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				code, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid status code %q: %v", d.Val(), err)
+				}
+				g.StatusCode = code
+			case "body":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				g.Body = d.Val()
+			case "body_file":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				g.BodyFile = d.Val()
+			case "retry_after":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return err
+				}
+				g.RetryAfter = caddy.Duration(val)
+			case "redirect":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				g.Redirect = d.Val()
+			default:
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
+
+func parseGeofenceCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	g := new(Geofence)
+	err := g.UnmarshalCaddyfile(h.Dispenser)
+	return g, err
+}
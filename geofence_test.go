@@ -0,0 +1,107 @@
+package geocn
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func serveGeofence(t *testing.T, g *Geofence, remoteAddr string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remoteAddr
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	w := httptest.NewRecorder()
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+	if err := g.ServeHTTP(w, r, next); err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	return w
+}
+
+func TestGeofence(t *testing.T) {
+	cn := newTestGeoCNApp(t)
+
+	t.Run("allow", func(t *testing.T) {
+		g := &Geofence{
+			Allow:      GeofenceRules{Countries: []string{"CN"}},
+			Body:       "blocked: {geofence.country}",
+			RetryAfter: caddy.Duration(90 * time.Second),
+			geoLocator: geoLocator{cn: cn},
+			logger:     zap.NewNop(),
+		}
+		g.body, g.contentType = g.Body, "text/plain"
+
+		if w := serveGeofence(t, g, "114.114.114.114:1234"); w.Code != http.StatusNoContent {
+			t.Errorf("CN client: status %d, want pass-through", w.Code)
+		}
+		// Unknown locations fail an allow list.
+		w := serveGeofence(t, g, "9.9.9.9:1234")
+		if w.Code != http.StatusForbidden {
+			t.Errorf("unknown client: status %d, want 403", w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != "90" {
+			t.Errorf("Retry-After = %q, want 90", got)
+		}
+		if got := w.Body.String(); got != "blocked: " {
+			t.Errorf("body = %q", got)
+		}
+	})
+
+	t.Run("deny redirect", func(t *testing.T) {
+		g := &Geofence{
+			Deny:       GeofenceRules{Countries: []string{"CN"}},
+			Redirect:   "https://example.com/blocked?c={geofence.country}",
+			geoLocator: geoLocator{cn: cn},
+			logger:     zap.NewNop(),
+		}
+		w := serveGeofence(t, g, "114.114.114.114:1234")
+		if w.Code != http.StatusFound {
+			t.Fatalf("status %d, want 302", w.Code)
+		}
+		if got := w.Header().Get("Location"); got != "https://example.com/blocked?c=CN" {
+			t.Errorf("Location = %q", got)
+		}
+		if w := serveGeofence(t, g, "9.9.9.9:1234"); w.Code != http.StatusNoContent {
+			t.Errorf("non-denied client: status %d, want pass-through", w.Code)
+		}
+	})
+}
+
+func TestGeofenceCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`geofence {
+		allow country cn hk
+		deny region 广东+电信
+		status 451
+		retry_after 1m
+	}`)
+	var g Geofence
+	if err := g.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if !slices.Equal(g.Allow.Countries, []string{"cn", "hk"}) || !slices.Equal(g.Deny.Regions, []string{"广东+电信"}) {
+		t.Errorf("unexpected rules: %+v %+v", g.Allow, g.Deny)
+	}
+	if g.StatusCode != 451 || time.Duration(g.RetryAfter) != time.Minute {
+		t.Errorf("unexpected response options: %+v", g)
+	}
+	if err := g.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	g = Geofence{Deny: GeofenceRules{Countries: []string{"US"}}, Redirect: "/", StatusCode: 403}
+	if err := g.Validate(); err == nil {
+		t.Error("expected redirect with non-3xx status to be rejected")
+	}
+}
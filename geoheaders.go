@@ -0,0 +1,158 @@
+package geocn
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+var (
+	_ caddy.Module                = (*GeoHeaders)(nil)
+	_ caddy.Provisioner           = (*GeoHeaders)(nil)
+	_ caddy.Validator             = (*GeoHeaders)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GeoHeaders)(nil)
+	_ caddyfile.Unmarshaler       = (*GeoHeaders)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(GeoHeaders{})
+	httpcaddyfile.RegisterHandlerDirective("geo_headers", parseGeoHeadersCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("geo_headers", httpcaddyfile.Before, "request_header")
+}
+
+// Default header names used by the Caddyfile when a field is enabled
+// without a name.
+const (
+	defaultCountryHeader  = "X-Geo-Country"
+	defaultProvinceHeader = "X-Geo-Province"
+	defaultCityHeader     = "X-Geo-City"
+	defaultISPHeader      = "X-Geo-ISP"
+)
+
+// GeoHeaders sets request headers with the client location so that
+// upstreams can use it without their own databases. Each field names the
+// header to set; empty fields are not set. The country code comes from the
+// geocn app, the other fields from the geocity app.
+//
+// Configured headers are always removed from the incoming request first, so
+// a client cannot supply its own values; a header stays absent when the
+// location is unknown.
+type GeoHeaders struct {
+	Country  string `json:"country,omitempty"`
+	Province string `json:"province,omitempty"`
+	City     string `json:"city,omitempty"`
+	ISP      string `json:"isp,omitempty"`
+
+	geoLocator
+	logger *zap.Logger
+}
+
+func (GeoHeaders) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geo_headers",
+		New: func() caddy.Module { return new(GeoHeaders) },
+	}
+}
+
+func (h *GeoHeaders) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger()
+	needCity := h.Province != "" || h.City != "" || h.ISP != ""
+	return h.provision(ctx, h.Country != "", needCity)
+}
+
+// Validate implements caddy.Validator.
+func (h *GeoHeaders) Validate() error {
+	if h.Country == "" && h.Province == "" && h.City == "" && h.ISP == "" {
+		return fmt.Errorf("geo_headers: at least one header must be configured")
+	}
+	return nil
+}
+
+func (h *GeoHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	for _, name := range []string{h.Country, h.Province, h.City, h.ISP} {
+		if name != "" {
+			r.Header.Del(name)
+		}
+	}
+
+	_, raw := extractClientIP(r)
+	loc := h.locate(r)
+	info := parseRegion(loc.region)
+
+	setHeader(r.Header, h.Country, loc.country)
+	setHeader(r.Header, h.Province, info.Province)
+	setHeader(r.Header, h.City, info.City)
+	setHeader(r.Header, h.ISP, info.ISP)
+
+	h.logger.Debug("geo headers set",
+		zap.String("client_ip", raw),
+		zap.String("country", loc.country),
+		zap.String("region", loc.region))
+
+	return next.ServeHTTP(w, r)
+}
+
+// setHeader sets name to value if both are non-empty.
+func setHeader(header http.Header, name, value string) {
+	if name != "" && value != "" {
+		header.Set(name, value)
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Without a block all
+// four headers are set with their default names. Syntax:
+//
+//	geo_headers {
+//	    country  [<header>]   # default X-Geo-Country
+//	    province [<header>]   # default X-Geo-Province
+//	    city     [<header>]   # default X-Geo-City
+//	    isp      [<header>]   # default X-Geo-ISP
+//	}
+func (h *GeoHeaders) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		hasBlock := false
+		for n := d.Nesting(); d.NextBlock(n); {
+			hasBlock = true
+			var field *string
+			var name string
+			switch d.Val() {
+			case "country":
+				field, name = &h.Country, defaultCountryHeader
+			case "province":
+				field, name = &h.Province, defaultProvinceHeader
+			case "city":
+				field, name = &h.City, defaultCityHeader
+			case "isp":
+				field, name = &h.ISP, defaultISPHeader
+			default:
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+			if d.NextArg() {
+				name = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			*field = name
+		}
+		if !hasBlock {
+			h.Country, h.Province = defaultCountryHeader, defaultProvinceHeader
+			h.City, h.ISP = defaultCityHeader, defaultISPHeader
+		}
+	}
+	return nil
+}
+
+func parseGeoHeadersCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := new(GeoHeaders)
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
+}
@@ -0,0 +1,83 @@
+package geocn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestGeoHeaders(t *testing.T) {
+	h := &GeoHeaders{
+		Country:    defaultCountryHeader,
+		Province:   defaultProvinceHeader,
+		City:       "X-City",
+		ISP:        defaultISPHeader,
+		geoLocator: geoLocator{cn: newTestGeoCNApp(t), city: newTestGeoCityApp(t)},
+		logger:     zap.NewNop(),
+	}
+
+	var got http.Header
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		got = r.Header.Clone()
+		return nil
+	})
+	serve := func(remoteAddr string) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Geo-Country", "US")
+		r.Header.Set("X-City", "spoofed")
+		if err := h.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+			t.Fatalf("ServeHTTP: %v", err)
+		}
+	}
+
+	serve("114.114.114.114:1234")
+	want := map[string]string{"X-Geo-Country": "CN", "X-Geo-Province": "江苏省", "X-City": "南京市", "X-Geo-ISP": "电信"}
+	for name, value := range want {
+		if got.Get(name) != value {
+			t.Errorf("%s = %q, want %q", name, got.Get(name), value)
+		}
+	}
+
+	// Client-supplied copies are dropped even when nothing is known.
+	serve("10.0.0.1:1234")
+	if v := got.Values("X-Geo-Country"); len(v) != 0 {
+		t.Errorf("X-Geo-Country = %q, want absent", v)
+	}
+	if v := got.Values("X-City"); len(v) != 0 {
+		t.Errorf("X-City = %q, want absent", v)
+	}
+}
+
+func TestGeoHeadersCaddyfile(t *testing.T) {
+	var h GeoHeaders
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geo_headers`)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if h.Country != defaultCountryHeader || h.ISP != defaultISPHeader {
+		t.Errorf("expected default headers, got %+v", h)
+	}
+
+	h = GeoHeaders{}
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geo_headers {
+		country
+		city X-Client-City
+	}`)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if h.Country != defaultCountryHeader || h.City != "X-Client-City" || h.Province != "" || h.ISP != "" {
+		t.Errorf("unexpected headers: %+v", h)
+	}
+
+	err := (&GeoHeaders{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geo_headers {
+		region X-Geo-Region
+	}`))
+	if err == nil || !strings.Contains(err.Error(), "unrecognized option 'region'") {
+		t.Errorf("expected an unrecognized option error, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package geocn
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+var (
+	_ caddy.Module                = (*GeoLog)(nil)
+	_ caddy.Provisioner           = (*GeoLog)(nil)
+	_ caddy.Validator             = (*GeoLog)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GeoLog)(nil)
+	_ caddyfile.Unmarshaler       = (*GeoLog)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(GeoLog{})
+	httpcaddyfile.RegisterHandlerDirective("geo_log", parseGeoLogCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("geo_log", httpcaddyfile.After, "log_append")
+}
+
+// Location fields GeoLog can add to access logs.
+var geoLogFields = []string{"country", "province", "city", "isp"}
+
+// GeoLog adds the client location to the request's access log entry as
+// geo_country, geo_province, geo_city and geo_isp, like log_append does for
+// other values. Results already resolved for the request by geo matchers or
+// handlers are reused, otherwise the lookup goes through the app caches.
+type GeoLog struct {
+	// Fields to add: country (geocn), province, city and isp (geocity).
+	// Defaults to all of them.
+	Fields []string `json:"fields,omitempty"`
+
+	geoLocator
+}
+
+func (GeoLog) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geo_log",
+		New: func() caddy.Module { return new(GeoLog) },
+	}
+}
+
+func (l *GeoLog) Provision(ctx caddy.Context) error {
+	if len(l.Fields) == 0 {
+		l.Fields = geoLogFields
+	}
+	needCity := slices.ContainsFunc(l.Fields, func(f string) bool { return f != "country" })
+	return l.provision(ctx, slices.Contains(l.Fields, "country"), needCity)
+}
+
+// Validate implements caddy.Validator.
+func (l *GeoLog) Validate() error {
+	for _, f := range l.Fields {
+		if !slices.Contains(geoLogFields, f) {
+			return fmt.Errorf("geo_log: unknown field %q (want country, province, city or isp)", f)
+		}
+	}
+	return nil
+}
+
+func (l *GeoLog) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// As with log_append, fields are added after the rest of the chain so
+	// the lookups matchers did along the way are reused.
+	err := next.ServeHTTP(w, r)
+
+	extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields)
+	if !ok {
+		return err
+	}
+	for _, f := range l.logFields(r) {
+		extra.Set(f)
+	}
+	return err
+}
+
+// logFields returns the configured location fields for the client of r.
+func (l *GeoLog) logFields(r *http.Request) []zap.Field {
+	loc := l.locate(r)
+	info := parseRegion(loc.region)
+	fields := make([]zap.Field, 0, len(l.Fields))
+	for _, f := range l.Fields {
+		var v string
+		switch f {
+		case "country":
+			v = loc.country
+		case "province":
+			v = info.Province
+		case "city":
+			v = info.City
+		case "isp":
+			v = info.ISP
+		}
+		fields = append(fields, zap.String("geo_"+f, v))
+	}
+	return fields
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	geo_log [country] [province] [city] [isp]
+func (l *GeoLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		l.Fields = append(l.Fields, d.RemainingArgs()...)
+		if d.NextBlock(0) {
+			return d.Err("geo_log does not take a block")
+		}
+	}
+	return nil
+}
+
+func parseGeoLogCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	l := new(GeoLog)
+	err := l.UnmarshalCaddyfile(h.Dispenser)
+	return l, err
+}
@@ -0,0 +1,37 @@
+package geocn
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestGeoLogReusesRequestLookups(t *testing.T) {
+	l := &GeoLog{
+		Fields:     geoLogFields,
+		geoLocator: geoLocator{cn: newTestGeoCNApp(t), city: newTestGeoCityApp(t)},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "114.114.114.114:1234"
+	r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+
+	// A matcher that already resolved the request leaves its result in the
+	// request vars; geo_log must use it rather than look up again.
+	caddyhttp.SetVar(r.Context(), countryVarKey, "HK")
+
+	got := map[string]string{}
+	for _, f := range l.logFields(r) {
+		got[f.Key] = f.String
+	}
+	want := map[string]string{"geo_country": "HK", "geo_province": "江苏省", "geo_city": "南京市", "geo_isp": "电信"}
+	if !maps.Equal(got, want) {
+		t.Errorf("logFields = %v, want %v", got, want)
+	}
+	if v := caddyhttp.GetVar(r.Context(), regionVarKey); v != "中国|0|江苏省|南京市|电信" {
+		t.Errorf("region var = %v, want the looked-up region", v)
+	}
+}
@@ -0,0 +1,192 @@
+package geocn
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+var (
+	_ caddy.Module          = (*GeoSelection)(nil)
+	_ caddy.Provisioner     = (*GeoSelection)(nil)
+	_ caddy.Validator       = (*GeoSelection)(nil)
+	_ reverseproxy.Selector = (*GeoSelection)(nil)
+	_ caddyfile.Unmarshaler = (*GeoSelection)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(GeoSelection{})
+}
+
+// GeoSelection is a reverse_proxy load balancing policy that routes clients
+// to upstreams by location. Rules are tried in order; the first rule that
+// matches the client and has an available upstream wins, and the fallback
+// policy picks among that rule's upstreams. When no rule applies (including
+// when the location is unknown) the fallback picks from the whole pool.
+type GeoSelection struct {
+	Rules []GeoUpstreamRule `json:"rules,omitempty"`
+
+	// The fallback policy, also used to choose among the upstreams of the
+	// matching rule. Defaults to `random`.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.reverse_proxy.selection_policies inline_key=policy"`
+
+	geoLocator
+	fallback reverseproxy.Selector
+	logger   *zap.Logger
+}
+
+// GeoUpstreamRule sends clients from a country or region to a subset of the
+// upstreams.
+type GeoUpstreamRule struct {
+	// Country is an ISO 3166-1 alpha-2 code, resolved by the geocn app.
+	Country string `json:"country,omitempty"`
+	// Region is a geocity region keyword, resolved by the geocity app.
+	Region string `json:"region,omitempty"`
+	// Upstreams are the dial addresses, as configured on reverse_proxy, that
+	// serve matching clients.
+	Upstreams []string `json:"upstreams,omitempty"`
+}
+
+func (r GeoUpstreamRule) match(loc location) bool {
+	if r.Country != "" {
+		return loc.match([]string{r.Country}, nil)
+	}
+	return loc.match(nil, []string{r.Region})
+}
+
+func (GeoSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.geo",
+		New: func() caddy.Module { return new(GeoSelection) },
+	}
+}
+
+func (s *GeoSelection) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger()
+
+	var needCN, needCity bool
+	for i := range s.Rules {
+		s.Rules[i].Country = strings.ToUpper(s.Rules[i].Country)
+		needCN = needCN || s.Rules[i].Country != ""
+		needCity = needCity || s.Rules[i].Region != ""
+	}
+	if err := s.provision(ctx, needCN, needCity); err != nil {
+		return err
+	}
+
+	if s.FallbackRaw == nil {
+		s.FallbackRaw = caddyconfig.JSONModuleObject(reverseproxy.RandomSelection{}, "policy", "random", nil)
+	}
+	mod, err := ctx.LoadModule(s, "FallbackRaw")
+	if err != nil {
+		return fmt.Errorf("loading fallback selection policy: %w", err)
+	}
+	s.fallback = mod.(reverseproxy.Selector)
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (s *GeoSelection) Validate() error {
+	if len(s.Rules) == 0 {
+		return fmt.Errorf("geo selection policy: at least one rule must be specified")
+	}
+	for i, r := range s.Rules {
+		if (r.Country == "") == (r.Region == "") {
+			return fmt.Errorf("geo selection policy: rule %d must set exactly one of country or region", i)
+		}
+		if len(r.Upstreams) == 0 {
+			return fmt.Errorf("geo selection policy: rule %d has no upstreams", i)
+		}
+	}
+	return nil
+}
+
+// Select returns an available host, if any.
+func (s *GeoSelection) Select(pool reverseproxy.UpstreamPool, req *http.Request, w http.ResponseWriter) *reverseproxy.Upstream {
+	loc := s.locate(req)
+
+	if loc.known() {
+		for _, r := range s.Rules {
+			if !r.match(loc) {
+				continue
+			}
+			var subset reverseproxy.UpstreamPool
+			for _, u := range pool {
+				if slices.Contains(r.Upstreams, u.Dial) {
+					subset = append(subset, u)
+				}
+			}
+			if upstream := s.fallback.Select(subset, req, w); upstream != nil {
+				return upstream
+			}
+			// Every upstream for this location is down; try later rules.
+			s.logger.Debug("no available upstream for geo rule",
+				zap.String("country", loc.country),
+				zap.String("region", loc.region),
+				zap.Strings("upstreams", r.Upstreams))
+		}
+	}
+
+	return s.fallback.Select(pool, req, w)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	lb_policy geo {
+//	    country  <code>    <upstream> [<upstream>...]
+//	    region   <keyword> <upstream> [<upstream>...]
+//	    fallback <policy>
+//	}
+func (s *GeoSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "country", "region":
+			kind := d.Val()
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			rule := GeoUpstreamRule{Upstreams: args[1:]}
+			if kind == "country" {
+				rule.Country = args[0]
+			} else {
+				rule.Region = args[0]
+			}
+			s.Rules = append(s.Rules, rule)
+		case "fallback":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.FallbackRaw != nil {
+				return d.Err("fallback selection policy already specified")
+			}
+			name := d.Val()
+			modID := "http.reverse_proxy.selection_policies." + name
+			unm, err := caddyfile.UnmarshalModule(d, modID)
+			if err != nil {
+				return err
+			}
+			sel, ok := unm.(reverseproxy.Selector)
+			if !ok {
+				return d.Errf("module %s (%T) is not a reverseproxy.Selector", modID, unm)
+			}
+			s.FallbackRaw = caddyconfig.JSONModuleObject(sel, "policy", name, nil)
+		default:
+			return d.Errf("unrecognized option '%s'", d.Val())
+		}
+	}
+	return nil
+}
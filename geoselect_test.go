@@ -0,0 +1,63 @@
+package geocn
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"go.uber.org/zap"
+)
+
+func TestGeoSelection(t *testing.T) {
+	s := &GeoSelection{
+		Rules:      []GeoUpstreamRule{{Country: "CN", Upstreams: []string{"cn:80"}}},
+		geoLocator: geoLocator{cn: newTestGeoCNApp(t)},
+		fallback:   new(reverseproxy.FirstSelection),
+		logger:     zap.NewNop(),
+	}
+	intl, cn := &reverseproxy.Upstream{Dial: "intl:80"}, &reverseproxy.Upstream{Dial: "cn:80"}
+	pool := reverseproxy.UpstreamPool{intl, cn}
+
+	selectFor := func(remoteAddr string) *reverseproxy.Upstream {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		return s.Select(pool, r, nil)
+	}
+
+	if got := selectFor("114.114.114.114:1234"); got != cn {
+		t.Errorf("CN client got %v, want cn:80", got)
+	}
+	if got := selectFor("9.9.9.9:1234"); got != intl {
+		t.Errorf("unknown client got %v, want fallback intl:80", got)
+	}
+	pool = reverseproxy.UpstreamPool{intl}
+	if got := selectFor("114.114.114.114:1234"); got != intl {
+		t.Errorf("CN client without cn:80 got %v, want fallback intl:80", got)
+	}
+}
+
+func TestGeoSelectionCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`geo {
+		country CN cn-a:80 cn-b:80
+		region 广东 gd:80
+		fallback round_robin
+	}`)
+	var s GeoSelection
+	if err := s.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if len(s.Rules) != 2 || s.Rules[0].Country != "CN" || !slices.Equal(s.Rules[0].Upstreams, []string{"cn-a:80", "cn-b:80"}) ||
+		s.Rules[1].Region != "广东" {
+		t.Errorf("unexpected rules: %+v", s.Rules)
+	}
+	if !strings.Contains(string(s.FallbackRaw), `"policy":"round_robin"`) {
+		t.Errorf("unexpected fallback: %s", s.FallbackRaw)
+	}
+	if err := s.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
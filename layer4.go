@@ -0,0 +1,122 @@
+//go:build geocn_l4
+
+package geocn
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/mholt/caddy-l4/layer4"
+	"go.uber.org/zap"
+)
+
+var (
+	_ caddy.Module          = (*L4GeoCN)(nil)
+	_ caddy.Provisioner     = (*L4GeoCN)(nil)
+	_ caddy.Validator       = (*L4GeoCN)(nil)
+	_ layer4.ConnMatcher    = (*L4GeoCN)(nil)
+	_ caddyfile.Unmarshaler = (*L4GeoCN)(nil)
+
+	_ caddy.Module          = (*L4GeoCity)(nil)
+	_ caddy.Provisioner     = (*L4GeoCity)(nil)
+	_ caddy.Validator       = (*L4GeoCity)(nil)
+	_ layer4.ConnMatcher    = (*L4GeoCity)(nil)
+	_ caddyfile.Unmarshaler = (*L4GeoCity)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(L4GeoCN{})
+	caddy.RegisterModule(L4GeoCity{})
+}
+
+// L4GeoCN matches caddy-l4 connections from China. It shares the global
+// geocn app and configuration syntax with the HTTP geocn matcher.
+type L4GeoCN struct {
+	GeoCN
+}
+
+func (L4GeoCN) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.geocn",
+		New: func() caddy.Module { return new(L4GeoCN) },
+	}
+}
+
+// Validate implements caddy.Validator. Layer 4 matchers always geolocate
+// the connection's remote address.
+func (m *L4GeoCN) Validate() error {
+	if m.ipSource != (ipSource{}) {
+		return fmt.Errorf("layer4 geocn matcher: source, source_fallback and chain are not supported")
+	}
+	return m.GeoCN.Validate()
+}
+
+// Match implements layer4.ConnMatcher.
+func (m *L4GeoCN) Match(cx *layer4.Connection) (bool, error) {
+	if m.app == nil {
+		m.logger.Error("geocn app not initialized")
+		return false, nil
+	}
+
+	raw := cx.RemoteAddr().String()
+	host := getHost(raw)
+	if host == "" {
+		return false, nil
+	}
+
+	country := m.app.lookupCountry(host)
+	matched := country == "CN"
+
+	m.logger.Debug("geocn layer4 match result",
+		zap.String("remote_addr", raw),
+		zap.String("country", country),
+		zap.Bool("is_cn", matched))
+
+	return matched, nil
+}
+
+// L4GeoCity matches caddy-l4 connections by region keywords, with the same
+// semantics and syntax as the HTTP geocity matcher.
+type L4GeoCity struct {
+	GeoCity
+}
+
+func (L4GeoCity) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.geocity",
+		New: func() caddy.Module { return new(L4GeoCity) },
+	}
+}
+
+// Validate implements caddy.Validator.
+func (g *L4GeoCity) Validate() error {
+	if g.ipSource != (ipSource{}) {
+		return fmt.Errorf("layer4 geocity matcher: source, source_fallback and chain are not supported")
+	}
+	return g.GeoCity.Validate()
+}
+
+// Match implements layer4.ConnMatcher.
+func (g *L4GeoCity) Match(cx *layer4.Connection) (bool, error) {
+	if g.app == nil {
+		g.logger.Error("geocity app not initialized")
+		return false, nil
+	}
+
+	raw := cx.RemoteAddr().String()
+	host := getHost(raw)
+	if host == "" {
+		return false, nil
+	}
+
+	region := g.app.lookupRegion(host)
+	matched := g.matches(host, region)
+
+	g.logger.Debug("geocity layer4 match result",
+		zap.String("remote_addr", raw),
+		zap.String("region", region),
+		zap.Bool("matched", matched))
+
+	return matched, nil
+}
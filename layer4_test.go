@@ -0,0 +1,95 @@
+//go:build geocn_l4
+
+package geocn
+
+import (
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/mholt/caddy-l4/layer4"
+	"go.uber.org/zap"
+)
+
+// remoteConn is a net.Conn reporting a fixed remote address.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+func newTestL4Connection(t *testing.T, remote string) *layer4.Connection {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	addr, err := net.ResolveTCPAddr("tcp", remote)
+	if err != nil {
+		t.Fatalf("ResolveTCPAddr: %v", err)
+	}
+	return layer4.WrapConnection(remoteConn{Conn: server, remote: addr}, nil, zap.NewNop())
+}
+
+func TestL4GeoCNMatch(t *testing.T) {
+	m := &L4GeoCN{GeoCN{app: newTestGeoCNApp(t), logger: zap.NewNop()}}
+	for remote, want := range map[string]bool{
+		"114.114.114.114:443": true,
+		"9.9.9.9:443":         false,
+		"10.0.0.1:443":        false,
+	} {
+		got, err := m.Match(newTestL4Connection(t, remote))
+		if err != nil || got != want {
+			t.Errorf("Match(%s) = %v, %v; want %v", remote, got, err, want)
+		}
+	}
+}
+
+func TestL4GeoCityMatch(t *testing.T) {
+	g := &L4GeoCity{GeoCity{allKeywords: []string{"江苏"}, app: newTestGeoCityApp(t), logger: zap.NewNop()}}
+	if ok, err := g.Match(newTestL4Connection(t, "114.114.114.114:443")); err != nil || !ok {
+		t.Errorf("expected a Jiangsu connection to match: %v, %v", ok, err)
+	}
+	if ok, _ := g.Match(newTestL4Connection(t, "8.8.8.8:443")); ok {
+		t.Error("expected a US connection not to match")
+	}
+}
+
+func TestL4MatchersCaddyfile(t *testing.T) {
+	var m L4GeoCN
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geocn`)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	var g L4GeoCity
+	if err := g.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geocity {
+		regions 广东 北京
+	}`)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if len(g.Regions) != 2 {
+		t.Errorf("regions = %v", g.Regions)
+	}
+
+	m = L4GeoCN{}
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geocn {
+		source {http.request.header.X-Real-IP}
+	}`)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if err := m.Validate(); err == nil {
+		t.Error("expected source to be rejected by the layer4 matcher")
+	}
+
+	if err := (&L4GeoCN{GeoCN{ipSource: ipSource{SourceFallback: sourceFallbackNoMatch}}}).Validate(); err == nil {
+		t.Error("expected source_fallback to be rejected by the layer4 geocn matcher")
+	}
+	if err := (&L4GeoCity{GeoCity{ipSource: ipSource{SourceFallback: sourceFallbackNoMatch}}}).Validate(); err == nil {
+		t.Error("expected source_fallback to be rejected by the layer4 geocity matcher")
+	}
+}
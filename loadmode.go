@@ -0,0 +1,85 @@
+package geocn
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
+	geoip2 "github.com/oschwald/geoip2-golang/v2"
+)
+
+// Database load modes selectable with "load_mode".
+const (
+	// loadMemory reads the whole file into the Go heap (default).
+	loadMemory = "memory"
+	// loadMmap maps the file read-only, keeping it out of the heap.
+	loadMmap = "mmap"
+	// loadVectorIndex (xdb only) keeps just the vector index in memory and
+	// reads segments from the file on each lookup.
+	loadVectorIndex = "vector_index"
+)
+
+// checkLoadMode validates mode against the modes the app supports.
+func checkLoadMode(mode string, supported ...string) error {
+	if mode == "" || slices.Contains(supported, mode) {
+		return nil
+	}
+	return fmt.Errorf("unknown load_mode %q (want %s)", mode, strings.Join(supported, ", "))
+}
+
+// openGeoIP opens a mmdb file in the given load mode. The returned close
+// func releases the reader and, in mmap mode, the mapping. Like xdb files,
+// mmdb files are mapped through mmapFile, which reads them into memory on
+// platforms where a mapped file could not be renamed over.
+func openGeoIP(mode, path string) (*geoip2.Reader, func(), error) {
+	if mode != loadMmap {
+		reader, err := openGeoIPFromFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func() { reader.Close() }, nil
+	}
+	data, unmap, err := mmapFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := geoip2.OpenBytes(data)
+	if err != nil {
+		unmap()
+		return nil, nil, err
+	}
+	return reader, func() {
+		reader.Close()
+		unmap()
+	}, nil
+}
+
+// openXDB opens an xdb file in the given load mode.
+func openXDB(mode string, version *xdb.Version, path string) (*xdbSearcher, error) {
+	switch mode {
+	case loadMmap:
+		data, unmap, err := mmapFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s, err := newXDBSearcher(version, data)
+		if err != nil {
+			unmap()
+			return nil, err
+		}
+		s.unmap = unmap
+		return s, nil
+	case loadVectorIndex:
+		vIndex, err := xdb.LoadVectorIndexFromFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s, err := xdb.NewWithVectorIndex(version, path, vIndex)
+		if err != nil {
+			return nil, err
+		}
+		return &xdbSearcher{Searcher: s}, nil
+	}
+	return openXDBFromFile(version, path)
+}
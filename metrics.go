@@ -0,0 +1,39 @@
+package geocn
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cacheStats is implemented by the lookup caches of both apps.
+type cacheStats interface {
+	Len() int
+	Bytes() int64
+}
+
+// registerCacheMetrics exposes the cache size as caddy_<app>_cache_entries
+// and caddy_<app>_cache_bytes. A nil registry (e.g. in tests) is ignored.
+func registerCacheMetrics(registry *prometheus.Registry, app string, cache cacheStats) error {
+	if registry == nil {
+		return nil
+	}
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "caddy",
+			Subsystem: app,
+			Name:      "cache_entries",
+			Help:      "Number of entries in the " + app + " lookup cache.",
+		}, func() float64 { return float64(cache.Len()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "caddy",
+			Subsystem: app,
+			Name:      "cache_bytes",
+			Help:      "Approximate memory used by the " + app + " lookup cache.",
+		}, func() float64 { return float64(cache.Bytes()) }),
+	}
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package geocn
+
+import "os"
+
+// mmapFile reads path into memory on platforms without mmap support, where
+// a mapped file could not be renamed over during updates anyway.
+func mmapFile(path string) ([]byte, func() error, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
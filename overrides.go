@@ -0,0 +1,203 @@
+package geocn
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// overrides holds static CIDR → value mappings that take precedence over the
+// database: inline entries from the config plus an optional file or URL that
+// is refreshed on the same cycle as the main database.
+type overrides struct {
+	inline    map[string]string
+	source    string
+	localFile string
+	// validValue checks each value, e.g. validCountryCode.
+	validValue func(string) error
+	table      atomic.Pointer[prefixTable]
+}
+
+// newOverrides validates the inline entries and returns a ready-to-use set.
+// validValue checks every value, inline or from the source. The source, if
+// any, is not read until load is called.
+func newOverrides(inline map[string]string, source string, validValue func(string) error) (*overrides, error) {
+	o := &overrides{inline: inline, source: source, validValue: validValue}
+	table, err := o.build(nil)
+	if err != nil {
+		return nil, err
+	}
+	o.table.Store(table)
+	return o, nil
+}
+
+// lookup returns the override value for addr, if any.
+func (o *overrides) lookup(addr netip.Addr) (string, bool) {
+	if o == nil {
+		return "", false
+	}
+	return o.table.Load().lookup(addr)
+}
+
+// load fetches the source (downloading it to localFile when it is a URL)
+// and installs the merged table. Inline entries win over file entries.
+func (o *overrides) load(ctx context.Context, client *http.Client) error {
+	if o.source == "" {
+		return nil
+	}
+	path := o.source
+	if isHTTPSource(o.source) {
+		if err := downloadFile(ctx, client, o.source, o.localFile); err != nil {
+			return fmt.Errorf("download overrides from %s: %w", o.source, err)
+		}
+		path = o.localFile
+	}
+	return o.reload(path)
+}
+
+// update refreshes a URL source when the remote copy changed, and re-reads
+// a local file source unconditionally.
+func (o *overrides) update(ctx context.Context, client *http.Client, interval time.Duration) error {
+	if o.source == "" {
+		return nil
+	}
+	if !isHTTPSource(o.source) {
+		return o.reload(o.source)
+	}
+
+	ok, err := checkRemoteUpdate(ctx, client, o.source, o.localFile, interval)
+	if err != nil || !ok {
+		return err
+	}
+
+	unlock, ok, err := tryLockFile(o.localFile)
+	if err != nil || !ok {
+		return err
+	}
+	defer unlock()
+
+	tempFile := o.localFile + ".temp"
+	os.Remove(tempFile)
+	defer os.Remove(tempFile)
+	if err := downloadFile(ctx, client, o.source, tempFile); err != nil {
+		return fmt.Errorf("download overrides failed: %w", err)
+	}
+	if _, err := readOverridesFile(tempFile, o.validValue); err != nil {
+		return fmt.Errorf("invalid overrides file: %w", err)
+	}
+	if err := os.Rename(tempFile, o.localFile); err != nil {
+		return fmt.Errorf("replace overrides file failed: %w", err)
+	}
+	return o.reload(o.localFile)
+}
+
+func (o *overrides) reload(path string) error {
+	entries, err := readOverridesFile(path, o.validValue)
+	if err != nil {
+		return err
+	}
+	table, err := o.build(entries)
+	if err != nil {
+		return err
+	}
+	o.table.Store(table)
+	return nil
+}
+
+// build merges file entries with the inline ones into a new table.
+func (o *overrides) build(entries map[netip.Prefix]string) (*prefixTable, error) {
+	table := new(prefixTable)
+	for prefix, value := range entries {
+		table.insert(prefix, value)
+	}
+	for cidr, value := range o.inline {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid override %q: %w", cidr, err)
+		}
+		if err := o.validValue(value); err != nil {
+			return nil, fmt.Errorf("invalid override value %q for %s: want %w", value, cidr, err)
+		}
+		table.insert(prefix, value)
+	}
+	return table, nil
+}
+
+func readOverridesFile(path string, validValue func(string) error) (map[netip.Prefix]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseOverrides(f, validValue)
+}
+
+// parseOverrides reads "<cidr> <value>" lines, separated by any run of
+// blanks, checking each value with validValue. Blank lines and lines
+// starting with # are ignored.
+func parseOverrides(r io.Reader, validValue func(string) error) (map[netip.Prefix]string, error) {
+	entries := make(map[netip.Prefix]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"<cidr> <value>\"", line)
+		}
+		cidr, value := fields[0], fields[1]
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := validValue(value); err != nil {
+			return nil, fmt.Errorf("line %d: invalid value %q: want %w", line, value, err)
+		}
+		entries[prefix.Masked()] = value
+	}
+	return entries, scanner.Err()
+}
+
+// parseOverridesBlock parses the overrides directive:
+//
+//	overrides [<file_or_url>] {
+//	    <cidr> <value>
+//	}
+func parseOverridesBlock(d *caddyfile.Dispenser, source *string, inline *map[string]string) error {
+	args := d.RemainingArgs()
+	switch len(args) {
+	case 0:
+	case 1:
+		*source = args[0]
+	default:
+		return d.ArgErr()
+	}
+	for n := d.Nesting(); d.NextBlock(n); {
+		cidr := d.Val()
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return d.Errf("invalid override %s: %v", cidr, err)
+		}
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		if *inline == nil {
+			*inline = make(map[string]string)
+		}
+		(*inline)[cidr] = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package geocn
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+var (
+	_ caddy.Module                = (*GeoRateLimit)(nil)
+	_ caddy.Provisioner           = (*GeoRateLimit)(nil)
+	_ caddy.Validator             = (*GeoRateLimit)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GeoRateLimit)(nil)
+	_ caddyfile.Unmarshaler       = (*GeoRateLimit)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(GeoRateLimit{})
+	httpcaddyfile.RegisterHandlerDirective("geo_ratelimit", parseGeoRateLimitCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("geo_ratelimit", httpcaddyfile.Before, "basic_auth")
+}
+
+// Location keys GeoRateLimit can group requests by.
+const (
+	rateKeyCountry  = "country"
+	rateKeyProvince = "province"
+	rateKeyCity     = "city"
+)
+
+// GeoRateLimit limits the request rate per location with token buckets.
+// All clients from one location share its bucket, so a whole country or
+// region can be throttled during an incident. Locations listed in Zones
+// use their own limit; every other location, including unknown ones
+// (keyed by the empty string), gets a bucket with the Default limit, or is
+// not limited when Default is unset. Rejected requests get 429 with
+// Retry-After.
+//
+// Buckets live in memory and are dropped by a periodic sweep once they
+// have been idle long enough to be full again.
+type GeoRateLimit struct {
+	// Key selects what requests are grouped by: country (geocn ISO code,
+	// default), province or city (geocity, as in the ip2region data, e.g.
+	// "广东省", "深圳市").
+	Key string `json:"key,omitempty"`
+	// Zones maps a location to its limit.
+	Zones map[string]*RateLimit `json:"zones,omitempty"`
+	// Default is the limit for locations not in Zones.
+	Default *RateLimit `json:"default,omitempty"`
+
+	geoLocator
+	buckets *bucketStore
+	logger  *zap.Logger
+}
+
+// RateLimit allows Events requests per Window, with bursts of up to Burst
+// requests (default Events).
+type RateLimit struct {
+	Events int            `json:"events"`
+	Window caddy.Duration `json:"window"`
+	Burst  int            `json:"burst,omitempty"`
+}
+
+func (l *RateLimit) validate() error {
+	if l.Events <= 0 || l.Window <= 0 {
+		return fmt.Errorf("events and window must be positive")
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+	return nil
+}
+
+// rate returns the refill rate in tokens per second.
+func (l *RateLimit) rate() float64 {
+	return float64(l.Events) / time.Duration(l.Window).Seconds()
+}
+
+func (l *RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Events
+}
+
+// refillTime is how long an empty bucket takes to fill up; a bucket idle
+// for that long is equivalent to a new one.
+func (l *RateLimit) refillTime() time.Duration {
+	return time.Duration(float64(l.burst()) / l.rate() * float64(time.Second))
+}
+
+// tokenBucket is the state of one location's limit.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// idle is how long the bucket takes to fill up; once it has been unused
+	// for that long it is equivalent to a new one and can be dropped.
+	idle time.Duration
+}
+
+// take consumes a token if one is available, otherwise it reports how long
+// until the next one is.
+func (b *tokenBucket) take(limit *RateLimit, now time.Time) (bool, time.Duration) {
+	rate, burst := limit.rate(), float64(limit.burst())
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// bucketStore holds the token buckets by location. Unlike the lookup cache
+// it never evicts a bucket that is still refilling: doing so would hand the
+// next request a full bucket and lift the limit.
+type bucketStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newBucketStore() *bucketStore {
+	return &bucketStore{buckets: make(map[string]*tokenBucket)}
+}
+
+// take consumes a token from the bucket for key, creating a full bucket
+// for limit if there is none. Creation and consumption happen under one
+// lock, so concurrent first requests share a bucket.
+func (s *bucketStore) take(key string, limit *RateLimit, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.burst()), last: now, idle: limit.refillTime()}
+		s.buckets[key] = b
+	}
+	return b.take(limit, now)
+}
+
+// sweep drops the buckets that have been idle long enough to be full.
+func (s *bucketStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, b := range s.buckets {
+		if now.Sub(b.last) >= b.idle {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// len returns the number of buckets held.
+func (s *bucketStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
+
+// cleanup sweeps idle buckets periodically until ctx is done.
+func (s *bucketStore) cleanup(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sweep(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (GeoRateLimit) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geo_ratelimit",
+		New: func() caddy.Module { return new(GeoRateLimit) },
+	}
+}
+
+func (g *GeoRateLimit) Provision(ctx caddy.Context) error {
+	g.logger = ctx.Logger()
+	if g.Key == "" {
+		g.Key = rateKeyCountry
+	}
+	if g.Key == rateKeyCountry {
+		zones := make(map[string]*RateLimit, len(g.Zones))
+		for k, v := range g.Zones {
+			zones[strings.ToUpper(k)] = v
+		}
+		g.Zones = zones
+	}
+	if err := g.provision(ctx, g.Key == rateKeyCountry, g.Key != rateKeyCountry); err != nil {
+		return err
+	}
+
+	g.buckets = newBucketStore()
+	go g.buckets.cleanup(ctx)
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (g *GeoRateLimit) Validate() error {
+	switch g.Key {
+	case "", rateKeyCountry, rateKeyProvince, rateKeyCity:
+	default:
+		return fmt.Errorf("geo_ratelimit: unknown key %q (want country, province or city)", g.Key)
+	}
+	if len(g.Zones) == 0 && g.Default == nil {
+		return fmt.Errorf("geo_ratelimit: at least one zone or a default limit must be specified")
+	}
+	for name, l := range g.Zones {
+		if l == nil {
+			return fmt.Errorf("geo_ratelimit: zone %q has no limit", name)
+		}
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("geo_ratelimit: zone %q: %w", name, err)
+		}
+	}
+	if g.Default != nil {
+		if err := g.Default.validate(); err != nil {
+			return fmt.Errorf("geo_ratelimit: default: %w", err)
+		}
+	}
+	return nil
+}
+
+// locationKey returns the value requests from the client of r are
+// grouped by.
+func (g *GeoRateLimit) locationKey(r *http.Request) string {
+	loc := g.locate(r)
+	switch g.Key {
+	case rateKeyProvince:
+		return parseRegion(loc.region).Province
+	case rateKeyCity:
+		return parseRegion(loc.region).City
+	}
+	return loc.country
+}
+
+func (g *GeoRateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	key := g.locationKey(r)
+	limit, ok := g.Zones[key]
+	if !ok {
+		limit = g.Default
+	}
+	if limit == nil {
+		return next.ServeHTTP(w, r)
+	}
+
+	allowed, wait := g.buckets.take(key, limit, time.Now())
+	if allowed {
+		return next.ServeHTTP(w, r)
+	}
+
+	g.logger.Debug("geo rate limit exceeded",
+		zap.String(g.Key, key),
+		zap.Duration("retry_after", wait))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return caddyhttp.Error(http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded for %s %q", g.Key, key))
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
+//
+//	geo_ratelimit {
+//	    key     country|province|city
+//	    zone    <location> <events> <window> [<burst>]
+//	    default <events> <window> [<burst>]
+//	}
+func (g *GeoRateLimit) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for n := d.Nesting(); d.NextBlock(n); {
+			switch d.Val() {
+			case "key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				g.Key = d.Val()
+			case "zone":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				limit, err := parseRateLimit(d)
+				if err != nil {
+					return err
+				}
+				if g.Zones == nil {
+					g.Zones = make(map[string]*RateLimit)
+				}
+				g.Zones[name] = limit
+			case "default":
+				limit, err := parseRateLimit(d)
+				if err != nil {
+					return err
+				}
+				g.Default = limit
+			default:
+				return d.Errf("unrecognized option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseRateLimit parses "<events> <window> [<burst>]".
+func parseRateLimit(d *caddyfile.Dispenser) (*RateLimit, error) {
+	args := d.RemainingArgs()
+	if len(args) < 2 || len(args) > 3 {
+		return nil, d.ArgErr()
+	}
+	events, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, d.Errf("invalid events %q: %v", args[0], err)
+	}
+	window, err := caddy.ParseDuration(args[1])
+	if err != nil {
+		return nil, d.Errf("invalid window %q: %v", args[1], err)
+	}
+	limit := &RateLimit{Events: events, Window: caddy.Duration(window)}
+	if len(args) == 3 {
+		if limit.Burst, err = strconv.Atoi(args[2]); err != nil {
+			return nil, d.Errf("invalid burst %q: %v", args[2], err)
+		}
+	}
+	return limit, nil
+}
+
+func parseGeoRateLimitCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	g := new(GeoRateLimit)
+	err := g.UnmarshalCaddyfile(h.Dispenser)
+	return g, err
+}
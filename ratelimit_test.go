@@ -0,0 +1,179 @@
+package geocn
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestGeoRateLimit(t *testing.T) {
+	g := &GeoRateLimit{
+		Key:        rateKeyCountry,
+		Zones:      map[string]*RateLimit{"CN": {Events: 2, Window: caddy.Duration(time.Minute)}},
+		geoLocator: geoLocator{cn: newTestGeoCNApp(t)},
+		buckets:    newBucketStore(),
+		logger:     zap.NewNop(),
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	serve := func(remoteAddr string) (http.Header, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		return w.Header(), g.ServeHTTP(w, r, next)
+	}
+
+	for i := range 2 {
+		if _, err := serve("114.114.114.114:1234"); err != nil {
+			t.Fatalf("request %d within the CN limit: %v", i, err)
+		}
+	}
+	// The bucket is shared by every client in the zone.
+	header, err := serve("114.114.114.115:1234")
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the CN bucket is empty, got %v", err)
+	}
+	if got := header.Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+
+	// Locations without a zone are not limited when there is no default.
+	for range 5 {
+		if _, err := serve("9.9.9.9:1234"); err != nil {
+			t.Fatalf("unlimited location rejected: %v", err)
+		}
+	}
+}
+
+func TestGeoRateLimitSeveralLimitedZones(t *testing.T) {
+	one := &RateLimit{Events: 1, Window: caddy.Duration(time.Minute)}
+	g := &GeoRateLimit{
+		Key:        rateKeyCountry,
+		Zones:      map[string]*RateLimit{"CN": one},
+		Default:    one,
+		geoLocator: geoLocator{cn: newTestGeoCNApp(t)},
+		buckets:    newBucketStore(),
+		logger:     zap.NewNop(),
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	serve := func(remoteAddr string) error {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		return g.ServeHTTP(httptest.NewRecorder(), r, next)
+	}
+
+	// Interleaved locations must not reset each other's buckets.
+	for _, addr := range []string{"114.114.114.114:1", "9.9.9.9:1"} {
+		if err := serve(addr); err != nil {
+			t.Fatalf("first request from %s: %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"114.114.114.114:1", "9.9.9.9:1"} {
+		if err := serve(addr); err == nil {
+			t.Errorf("second request from %s allowed", addr)
+		}
+	}
+}
+
+func TestBucketStoreKeepsEveryLimitedZone(t *testing.T) {
+	s := newBucketStore()
+	limit := &RateLimit{Events: 1, Window: caddy.Duration(time.Minute)}
+	now := time.Now()
+	// Every limited zone keeps its bucket, however many there are.
+	for i := range 100 {
+		if ok, _ := s.take(strconv.Itoa(i), limit, now); !ok {
+			t.Fatalf("zone %d: first request rejected", i)
+		}
+	}
+	for i := range 100 {
+		if ok, _ := s.take(strconv.Itoa(i), limit, now); ok {
+			t.Fatalf("zone %d: second request allowed; its bucket was lost", i)
+		}
+	}
+	if n := s.len(); n != 100 {
+		t.Errorf("len = %d, want 100", n)
+	}
+
+	// Only buckets that would be full again are swept.
+	s.take("fresh", limit, now.Add(30*time.Second))
+	s.sweep(now.Add(time.Minute))
+	if n := s.len(); n != 1 {
+		t.Errorf("after sweep len = %d, want 1 (the refilling bucket)", n)
+	}
+}
+
+func TestBucketStoreConcurrentFirstRequests(t *testing.T) {
+	s := newBucketStore()
+	limit := &RateLimit{Events: 1, Window: caddy.Duration(time.Minute)}
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Go(func() {
+			if ok, _ := s.take("CN", limit, time.Now()); ok {
+				allowed.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	if n := allowed.Load(); n != 1 {
+		t.Errorf("%d concurrent first requests allowed, want 1", n)
+	}
+}
+
+func TestTokenBucketRefills(t *testing.T) {
+	limit := &RateLimit{Events: 10, Window: caddy.Duration(10 * time.Second), Burst: 2}
+	now := time.Now()
+	b := &tokenBucket{tokens: 2, last: now}
+	for range 2 {
+		if ok, _ := b.take(limit, now); !ok {
+			t.Fatal("expected burst tokens to be available")
+		}
+	}
+	if ok, wait := b.take(limit, now); ok || wait != time.Second {
+		t.Fatalf("empty bucket: ok=%v wait=%v, want false 1s", ok, wait)
+	}
+	if ok, _ := b.take(limit, now.Add(time.Second)); !ok {
+		t.Error("expected a token after one refill interval")
+	}
+	if got := limit.refillTime(); got != 2*time.Second {
+		t.Errorf("refillTime = %v, want 2s", got)
+	}
+}
+
+func TestGeoRateLimitCaddyfile(t *testing.T) {
+	var g GeoRateLimit
+	err := g.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geo_ratelimit {
+		key province
+		zone 广东省 10 1s 20
+		default 100 1m
+	}`))
+	if err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	zone := g.Zones["广东省"]
+	if g.Key != rateKeyProvince || zone == nil || zone.Events != 10 || zone.Burst != 20 ||
+		g.Default == nil || time.Duration(g.Default.Window) != time.Minute {
+		t.Errorf("unexpected config: %+v zone=%+v default=%+v", g, zone, g.Default)
+	}
+	if err := g.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	err = (&GeoRateLimit{}).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`geo_ratelimit {
+		zones CN 10 1s
+	}`))
+	if err == nil || !strings.Contains(err.Error(), "unrecognized option 'zones'") {
+		t.Errorf("expected an unrecognized option error, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package geocn
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// dbSnapshot is a loaded database as seen by lookups: the reader plus the
+// metadata describing it. Lookups pin the snapshot for their duration, so
+// a replaced reader is released only after the last in-flight lookup that
+// uses it has finished.
+type dbSnapshot[T any] struct {
+	db T
+	// key identifies the database content (the dbPool key); empty when the
+	// reader is not pooled.
+	key string
+
+	// refs is 1 while the snapshot is current, plus 1 per pinning lookup.
+	refs    atomic.Int64
+	release func()
+	// retired runs after release when a different database replaced this
+	// one; it is set before the holder drops its reference.
+	retired func()
+}
+
+// pin adds a reference unless the snapshot has already been released.
+func (s *dbSnapshot[T]) pin() bool {
+	for {
+		n := s.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if s.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// done drops a reference, releasing the reader with the last one.
+func (s *dbSnapshot[T]) done() {
+	if s.refs.Add(-1) != 0 {
+		return
+	}
+	s.release()
+	if s.retired != nil {
+		s.retired()
+	}
+}
+
+// dbHolder holds the current snapshot of one database. Lookups read it
+// without locking; swaps are serialized among themselves only.
+type dbHolder[T any] struct {
+	current atomic.Pointer[dbSnapshot[T]]
+	swapMu  sync.Mutex
+}
+
+// acquire pins and returns the current snapshot, or nil if no database is
+// loaded. The caller must call done on the result.
+func (h *dbHolder[T]) acquire() *dbSnapshot[T] {
+	for {
+		s := h.current.Load()
+		if s == nil || s.pin() {
+			return s
+		}
+		// s was released between Load and pin; a newer one is installed.
+	}
+}
+
+// swap installs db as the current snapshot. release frees db once it has
+// been replaced and is no longer pinned. onReplaced, if not nil, runs after
+// the previous snapshot is released when the new content differs from it,
+// i.e. when results derived from the old database are stale.
+func (h *dbHolder[T]) swap(db T, key string, release func(), onReplaced func()) {
+	s := &dbSnapshot[T]{
+		db:      db,
+		key:     key,
+		release: release,
+	}
+	s.refs.Store(1)
+
+	h.swapMu.Lock()
+	defer h.swapMu.Unlock()
+	old := h.current.Swap(s)
+	if old == nil {
+		return
+	}
+	if onReplaced != nil && (key == "" || key != old.key) {
+		old.retired = onReplaced
+	}
+	old.done()
+}
+
+// close drops the current snapshot; its reader is released once the last
+// in-flight lookup finishes. A nil holder is a no-op.
+func (h *dbHolder[T]) close() {
+	if h == nil {
+		return
+	}
+	h.swapMu.Lock()
+	defer h.swapMu.Unlock()
+	if old := h.current.Swap(nil); old != nil {
+		old.done()
+	}
+}
+
+// contentKey returns the key of the current snapshot, identifying the
+// database content, or "" if none is installed or it is not pooled.
+func (h *dbHolder[T]) contentKey() string {
+	if s := h.current.Load(); s != nil {
+		return s.key
+	}
+	return ""
+}
+
+// loaded reports whether a database is installed.
+func (h *dbHolder[T]) loaded() bool {
+	return h.current.Load() != nil
+}
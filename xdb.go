@@ -0,0 +1,165 @@
+package geocn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/lionsoul2014/ip2region/binding/golang/xdb"
+)
+
+// xdbSearcher pairs an xdb.Searcher with the buffer it was loaded from, so
+// that lookups can also report the network the matched segment covers.
+type xdbSearcher struct {
+	*xdb.Searcher
+	content []byte       // nil when the searcher reads from a file handle
+	unmap   func() error // releases a memory-mapped content buffer
+	poolKey string       // dbPool key; empty if not pooled
+
+	// fileMu serializes lookups that seek and read the shared file handle.
+	fileMu sync.Mutex
+}
+
+// Close closes the file handle or unmaps the content buffer.
+func (s *xdbSearcher) Close() {
+	s.Searcher.Close()
+	if s.unmap != nil {
+		s.unmap()
+	}
+}
+
+// search returns the region for addr together with the largest prefix
+// around addr that lies inside the matched xdb segment. Without a content
+// buffer the network degrades to the single address.
+func (s *xdbSearcher) search(addr netip.Addr) (string, netip.Prefix, error) {
+	if s.content == nil {
+		s.fileMu.Lock()
+		region, err := s.Search(addr.AsSlice())
+		s.fileMu.Unlock()
+		return region, hostPrefix(addr), err
+	}
+
+	version := s.IPVersion()
+	ip := addr.AsSlice()
+	if len(ip) != version.Bytes {
+		return "", netip.Prefix{}, fmt.Errorf("invalid ip address(%s expected)", version.Name)
+	}
+
+	// Same vector index + binary search as xdb.Searcher.Search, but keeping
+	// the segment bounds instead of discarding them.
+	idx := xdb.HeaderInfoLength + int(ip[0])*xdb.VectorIndexCols*xdb.VectorIndexSize + int(ip[1])*xdb.VectorIndexSize
+	if idx+8 > len(s.content) {
+		return "", netip.Prefix{}, fmt.Errorf("vector index out of range")
+	}
+	sPtr := binary.LittleEndian.Uint32(s.content[idx:])
+	ePtr := binary.LittleEndian.Uint32(s.content[idx+4:])
+
+	n := version.Bytes
+	segSize := uint32(version.SegmentIndexSize)
+	l, h := 0, int((ePtr-sPtr)/segSize)
+	for l <= h {
+		m := (l + h) >> 1
+		p := int(sPtr + uint32(m)*segSize)
+		if p+int(segSize) > len(s.content) {
+			return "", netip.Prefix{}, fmt.Errorf("segment index out of range")
+		}
+		seg := s.content[p : p+int(segSize)]
+		start, end := segmentIP(seg[:n]), segmentIP(seg[n:2*n])
+		switch {
+		case addr.Less(start):
+			h = m - 1
+		case end.Less(addr):
+			l = m + 1
+		default:
+			dataLen := int(binary.LittleEndian.Uint16(seg[2*n:]))
+			dataPtr := int(binary.LittleEndian.Uint32(seg[2*n+2:]))
+			if dataPtr+dataLen > len(s.content) {
+				return "", netip.Prefix{}, fmt.Errorf("region data out of range")
+			}
+			return string(s.content[dataPtr : dataPtr+dataLen]), rangePrefix(addr, start, end), nil
+		}
+	}
+	return "", hostPrefix(addr), nil
+}
+
+// segmentIP decodes a segment bound: IPv4 bounds are stored little endian,
+// IPv6 bounds big endian.
+func segmentIP(b []byte) netip.Addr {
+	if len(b) == 4 {
+		return netip.AddrFrom4([4]byte{b[3], b[2], b[1], b[0]})
+	}
+	return netip.AddrFrom16([16]byte(b))
+}
+
+// rangePrefix returns the shortest prefix containing addr that fits entirely
+// within [start, end].
+func rangePrefix(addr, start, end netip.Addr) netip.Prefix {
+	for bits := 0; bits < addr.BitLen(); bits++ {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			break
+		}
+		if !prefix.Addr().Less(start) && !end.Less(lastAddr(prefix)) {
+			return prefix
+		}
+	}
+	return hostPrefix(addr)
+}
+
+// lastAddr returns the highest address inside prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// openXDBFromFile loads an xdb file entirely into memory and returns a Searcher.
+// This avoids holding file handles open, which prevents os.Rename failures on Windows.
+func openXDBFromFile(version *xdb.Version, path string) (*xdbSearcher, error) {
+	data, err := xdb.LoadContentFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newXDBSearcher(version, data)
+}
+
+// acquireXDB returns the pooled searcher for the xdb file at path, loading
+// it in mode only when no app instance holds identical content for source yet.
+func acquireXDB(mode string, version *xdb.Version, source, path string) (*xdbSearcher, bool, error) {
+	key, err := fileDBKey("geocity|"+version.Name+"|"+mode, source, path)
+	if err != nil {
+		return nil, false, err
+	}
+	return acquireDB(key, func() (*xdbSearcher, func(), error) {
+		s, err := openXDB(mode, version, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.poolKey = key
+		return s, s.Close, nil
+	})
+}
+
+// release drops this app's use of s: pooled searchers go back to dbPool,
+// others are closed.
+func (s *xdbSearcher) release() {
+	if s.poolKey != "" {
+		releaseDB(s.poolKey)
+		return
+	}
+	s.Close()
+}
+
+// newXDBSearcher creates a searcher over an in-memory xdb buffer.
+func newXDBSearcher(version *xdb.Version, data []byte) (*xdbSearcher, error) {
+	s, err := xdb.NewWithBuffer(version, data)
+	if err != nil {
+		return nil, err
+	}
+	return &xdbSearcher{Searcher: s, content: slices.Clip(data)}, nil
+}